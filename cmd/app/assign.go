@@ -0,0 +1,96 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"fmt"
+
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/claimcontroller"
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/extensions"
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/netutils"
+
+	"github.com/golang/glog"
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var forceIPChange bool
+
+func init() {
+	for _, cmd := range []*cobra.Command{Assign, Release} {
+		cmd.Flags().BoolVar(&forceIPChange, "force", false, "Change IP even if it is claimed by other node (assign) or by this node (release)")
+		Root.AddCommand(cmd)
+	}
+}
+
+var Assign = &cobra.Command{
+	Use:   "assign <cidr>",
+	Short: "Assign IP on this node and exit, IP should not be claimed by other nodes",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runIPCommand(args, true)
+	},
+}
+
+var Release = &cobra.Command{
+	Use:   "release <cidr>",
+	Short: "Remove IP from this node and exit, IP should not be claimed by this node",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runIPCommand(args, false)
+	},
+}
+
+func runIPCommand(args []string, assign bool) error {
+	if len(args) != 1 {
+		return fmt.Errorf("Exactly one cidr is expected, got %v", args)
+	}
+	uid, err := AppOpts.NodeUID()
+	if err != nil {
+		return err
+	}
+	ext, err := newExtClientset()
+	if err != nil {
+		return err
+	}
+	return changeIP(ext, ipHandler(), uid, AppOpts.Iface, args[0], assign, forceIPChange)
+}
+
+// changeIP assigns or removes cidr on iface once. Claims are checked first,
+// so the IP is not taken from other node or removed while this node is
+// expected to serve it, unless force is set
+func changeIP(ext extensions.ExtensionsClientset, handler netutils.IPHandler, uid, iface, cidr string, assign, force bool) error {
+	// claims refer to nodes by uid of claim controller
+	uid = claimcontroller.NormalizeUid(uid)
+	claims, err := ext.IPClaims().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, claim := range claims.Items {
+		if claim.Spec.Cidr != cidr || claim.Spec.NodeName == "" || force {
+			continue
+		}
+		if assign && claim.Spec.NodeName != uid {
+			return fmt.Errorf("IP %v is claimed by node %v, use --force to assign it anyway", cidr, claim.Spec.NodeName)
+		}
+		if !assign && claim.Spec.NodeName == uid {
+			return fmt.Errorf("IP %v is claimed by this node and will be assigned again, use --force to release it anyway", cidr)
+		}
+	}
+	if assign {
+		glog.V(0).Infof("Assigning IP %v on link %v", cidr, iface)
+		return handler.Add(iface, cidr)
+	}
+	glog.V(0).Infof("Removing IP %v from link %v", cidr, iface)
+	return handler.Del(iface, cidr)
+}
@@ -0,0 +1,82 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"testing"
+
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/extensions"
+	fclient "github.com/Mirantis/k8s-externalipcontroller/pkg/extensions/testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type fakeIPHandler struct {
+	mock.Mock
+}
+
+func (f *fakeIPHandler) Add(iface, cidr string) error {
+	return f.Called(iface, cidr).Error(0)
+}
+
+func (f *fakeIPHandler) Del(iface, cidr string) error {
+	return f.Called(iface, cidr).Error(0)
+}
+
+func TestChangeIP(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	ext.Ipclaims.On("List", mock.Anything).Return(&extensions.IpClaimList{Items: []extensions.IpClaim{
+		{Spec: extensions.IpClaimSpec{Cidr: "10.10.0.2/32", NodeName: "first"}},
+		{Spec: extensions.IpClaimSpec{Cidr: "10.10.0.3/32", NodeName: "second"}},
+	}}, nil)
+	handler := &fakeIPHandler{}
+	handler.On("Add", "eth0", "10.10.0.2/32").Return(nil).Once()
+	handler.On("Add", "eth0", "10.10.0.4/32").Return(nil).Once()
+	handler.On("Del", "eth0", "10.10.0.3/32").Return(nil).Once()
+	handler.On("Add", "eth0", "10.10.0.3/32").Return(nil).Once()
+	handler.On("Del", "eth0", "10.10.0.2/32").Return(nil).Once()
+
+	assert.NoError(t, changeIP(ext, handler, "first", "eth0", "10.10.0.2/32", true, false))
+	assert.NoError(t, changeIP(ext, handler, "first", "eth0", "10.10.0.4/32", true, false),
+		"IP that is not claimed should be assigned")
+	assert.NoError(t, changeIP(ext, handler, "first", "eth0", "10.10.0.3/32", false, false))
+	assert.Len(t, handler.Calls, 3)
+
+	assert.Error(t, changeIP(ext, handler, "first", "eth0", "10.10.0.3/32", true, false),
+		"IP claimed by other node should not be assigned")
+	assert.Error(t, changeIP(ext, handler, "first", "eth0", "10.10.0.2/32", false, false),
+		"IP claimed by this node should not be released")
+	assert.Len(t, handler.Calls, 3)
+
+	assert.NoError(t, changeIP(ext, handler, "first", "eth0", "10.10.0.3/32", true, true))
+	assert.NoError(t, changeIP(ext, handler, "first", "eth0", "10.10.0.2/32", false, true))
+	handler.AssertExpectations(t)
+}
+
+func TestChangeIPDottedHostname(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	ext.Ipclaims.On("List", mock.Anything).Return(&extensions.IpClaimList{Items: []extensions.IpClaim{
+		{Spec: extensions.IpClaimSpec{Cidr: "10.10.0.2/32", NodeName: "node-1-example-com"}},
+	}}, nil)
+	handler := &fakeIPHandler{}
+	handler.On("Add", "eth0", "10.10.0.2/32").Return(nil).Once()
+
+	assert.NoError(t, changeIP(ext, handler, "node-1.example.com", "eth0", "10.10.0.2/32", true, false),
+		"IP claimed by this node should be assigned")
+	assert.Error(t, changeIP(ext, handler, "node-1.example.com", "eth0", "10.10.0.2/32", false, false),
+		"IP claimed by this node should not be released")
+	handler.AssertExpectations(t)
+}
@@ -0,0 +1,144 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/extensions"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+var claimsOutput string
+
+func init() {
+	Claims.Flags().StringVarP(&claimsOutput, "output", "o", "table", "Output format: table|json")
+	Root.AddCommand(Claims)
+}
+
+var Claims = &cobra.Command{
+	Use:   "claims",
+	Short: "Print nodes that own external IPs",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return PrintClaims(os.Stdout, claimsOutput)
+	},
+}
+
+type claimAssignment struct {
+	Cidr string `json:"cidr"`
+	Node string `json:"node"`
+	Link string `json:"link,omitempty"`
+}
+
+func PrintClaims(w io.Writer, output string) error {
+	ext, err := newExtClientset()
+	if err != nil {
+		return err
+	}
+	claims, err := ext.IPClaims().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	return printAssignments(w, claimAssignments(claims.Items), output)
+}
+
+// newExtClientset returns extensions client configured with kubeconfig
+func newExtClientset() (extensions.ExtensionsClientset, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", AppOpts.Kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	ext, err := extensions.WrapClientsetWithExtensions(clientset, config)
+	if err != nil {
+		return nil, err
+	}
+	return ext, nil
+}
+
+// claimAssignments returns cidr to node mapping sorted by cidr
+func claimAssignments(claims []extensions.IpClaim) []claimAssignment {
+	result := make([]claimAssignment, 0, len(claims))
+	for _, claim := range claims {
+		result = append(result, claimAssignment{
+			Cidr: claim.Spec.Cidr,
+			Node: claim.Spec.NodeName,
+			Link: claim.Spec.Link,
+		})
+	}
+	sort.Sort(byCidr(result))
+	return result
+}
+
+type byCidr []claimAssignment
+
+func (b byCidr) Len() int           { return len(b) }
+func (b byCidr) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byCidr) Less(i, j int) bool { return lessCidr(b[i].Cidr, b[j].Cidr) }
+
+// lessCidr orders cidrs by address and then by prefix length, so that
+// 10.0.0.2/32 goes before 10.0.0.10/32. Cidrs that can not be parsed go last
+// in lexical order
+func lessCidr(a, b string) bool {
+	ipa, neta, erra := net.ParseCIDR(a)
+	ipb, netb, errb := net.ParseCIDR(b)
+	if erra != nil || errb != nil {
+		if (erra == nil) != (errb == nil) {
+			return erra == nil
+		}
+		return a < b
+	}
+	if cmp := bytes.Compare(ipa.To16(), ipb.To16()); cmp != 0 {
+		return cmp < 0
+	}
+	onesa, _ := neta.Mask.Size()
+	onesb, _ := netb.Mask.Size()
+	return onesa < onesb
+}
+
+func printAssignments(w io.Writer, assignments []claimAssignment, output string) error {
+	switch output {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(assignments)
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "CIDR\tNODE")
+		for _, a := range assignments {
+			node := a.Node
+			if node == "" {
+				node = "<none>"
+			}
+			fmt.Fprintf(tw, "%s\t%s\n", a.Cidr, node)
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("Unknown output format '%v', expected table or json", output)
+}
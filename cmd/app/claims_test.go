@@ -0,0 +1,63 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/extensions"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintAssignments(t *testing.T) {
+	claims := []extensions.IpClaim{
+		{Spec: extensions.IpClaimSpec{Cidr: "10.0.0.2/32", NodeName: "node-2", Link: "eth0"}},
+		{Spec: extensions.IpClaimSpec{Cidr: "10.0.0.1/32", NodeName: "node-1"}},
+		{Spec: extensions.IpClaimSpec{Cidr: "10.0.0.3/32"}},
+	}
+	assignments := claimAssignments(claims)
+	assert.Equal(t, []claimAssignment{
+		{Cidr: "10.0.0.1/32", Node: "node-1"},
+		{Cidr: "10.0.0.2/32", Node: "node-2", Link: "eth0"},
+		{Cidr: "10.0.0.3/32"},
+	}, assignments)
+
+	var out bytes.Buffer
+	assert.NoError(t, printAssignments(&out, assignments, "table"))
+	assert.Equal(t, "CIDR         NODE\n"+
+		"10.0.0.1/32  node-1\n"+
+		"10.0.0.2/32  node-2\n"+
+		"10.0.0.3/32  <none>\n", out.String())
+
+	out.Reset()
+	assert.NoError(t, printAssignments(&out, assignments[:1], "json"))
+	assert.JSONEq(t, `[{"cidr": "10.0.0.1/32", "node": "node-1"}]`, out.String())
+
+	assert.Error(t, printAssignments(&out, assignments, "yaml"))
+}
+
+func TestClaimAssignmentsOrder(t *testing.T) {
+	claims := []extensions.IpClaim{}
+	for _, cidr := range []string{"garbage", "10.0.0.10/32", "10.0.0.2/32", "10.0.0.0/24", "9.0.0.1/32", "10.0.0.0/28"} {
+		claims = append(claims, extensions.IpClaim{Spec: extensions.IpClaimSpec{Cidr: cidr}})
+	}
+	cidrs := []string{}
+	for _, a := range claimAssignments(claims) {
+		cidrs = append(cidrs, a.Cidr)
+	}
+	assert.Equal(t, []string{"9.0.0.1/32", "10.0.0.0/24", "10.0.0.0/28", "10.0.0.2/32", "10.0.0.10/32", "garbage"}, cidrs)
+}
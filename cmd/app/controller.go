@@ -15,11 +15,9 @@
 package app
 
 import (
-	"os"
-	"time"
-
 	"github.com/Mirantis/k8s-externalipcontroller/pkg/claimcontroller"
 	"github.com/Mirantis/k8s-externalipcontroller/pkg/extensions"
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/netutils"
 
 	"github.com/spf13/cobra"
 	"k8s.io/client-go/rest"
@@ -43,31 +41,59 @@ func InitController() error {
 	var config *rest.Config
 	kubeconfig := AppOpts.Kubeconfig
 	iface := AppOpts.Iface
-	hostname := AppOpts.Hostname
 	config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
 	if err != nil {
 		return err
 	}
-	uid := hostname
-	if hostname == "" {
-		uid, err = os.Hostname()
+	if err := serveDaemonEndpoints(); err != nil {
+		return err
+	}
+	if err := preflight(config); err != nil {
+		return err
+	}
+	if err := preflightNetlink(); err != nil {
+		return err
 	}
+	uid, err := AppOpts.NodeUID()
 	if err != nil {
 		return err
 	}
-	stop := make(chan struct{})
-	c, err := claimcontroller.NewClaimController(iface, uid, config, AppOpts.ResyncInterval, AppOpts.HeartbeatInterval)
+	cleanup, err := prepareIface(iface)
 	if err != nil {
 		return err
 	}
-	err = extensions.EnsureCRDsExist(config)
+	defer cleanup()
+	stop := stopOnSignal()
+	// claims with a link share the handler, so rate limit and hooks apply
+	// to all IPs
+	handler := linkIPHandler()
+	c, err := claimcontroller.NewClaimController(iface, uid, config, AppOpts.ResyncInterval, AppOpts.HeartbeatInterval, selectingIPHandler(handler))
+	if err != nil {
+		return err
+	}
+	c.LinkIPHandler = handler
+	c.ReconcileOnStart = AppOpts.ReconcileOnStart
+	c.ReconcilePeriod = AppOpts.ReconcilePeriod
+	c.MaxAssignRetries = AppOpts.MaxAssignRetries
+	c.CleanupConcurrency = AppOpts.CleanupConcurrency
+	c.AssignWorkers = AppOpts.AssignWorkers
+	c.StartupJitter = AppOpts.StartupJitter
+	if AppOpts.AssignMode == netutils.AssignModeRoute {
+		c.RouteTable = AppOpts.RouteTable
+	}
+	if AppOpts.Observer {
+		c.ExtensionsClientset = extensions.NewReadOnlyClientset(c.ExtensionsClientset)
+		c.Recorder = nil
+	}
+	err = prepareCRDs(config)
 	if err != nil {
 		return err
 	}
-	err = extensions.WaitCRDsEstablished(config, 10*time.Second)
+	err = setReady(config, c.HasSynced)
 	if err != nil {
 		return err
 	}
+	appStatus.SetAlive()
 	c.Run(stop)
 	return nil
 }
@@ -0,0 +1,113 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/health"
+
+	"github.com/golang/glog"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+var (
+	// appStatus is reported by /healthz and /readyz
+	appStatus = &health.Status{}
+	// healthzMux serves health checks and debug endpoints on healthz-addr
+	healthzMux = http.NewServeMux()
+)
+
+// serveHealthz listens on addr right away, so the error is returned if the
+// address is taken, and serves health checks in background
+func serveHealthz(addr string) error {
+	appStatus.InstallHandlers(healthzMux)
+	return serve("Health check", addr, healthzMux)
+}
+
+func serve(name, addr string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("%s server can't listen on %v: %v", name, addr, err)
+	}
+	glog.V(0).Infof("%s server listens on %v", name, addr)
+	go func() {
+		glog.Errorf("%s server failed: %v", name, http.Serve(listener, handler))
+	}()
+	return nil
+}
+
+// serveDaemonEndpoints starts metrics and health check servers of long
+// running commands, one-shot commands don't serve anything
+func serveDaemonEndpoints() error {
+	if AppOpts.MetricsAddr != "" {
+		if err := serveMetrics(AppOpts.MetricsAddr); err != nil {
+			return err
+		}
+	}
+	if AppOpts.HealthzAddr != "" {
+		return serveHealthz(AppOpts.HealthzAddr)
+	}
+	return nil
+}
+
+// preflightTimeout bounds every request of the preflight check
+const preflightTimeout = 5 * time.Second
+
+// preflight checks that kubernetes api is reachable and accepts credentials
+// of the application, so misconfiguration is reported right away instead of
+// failing in background loops
+func preflight(config *rest.Config) error {
+	if AppOpts.NoPreflight {
+		return nil
+	}
+	cfg := *config
+	cfg.Timeout = preflightTimeout
+	client, err := kubernetes.NewForConfig(&cfg)
+	if err != nil {
+		return err
+	}
+	if _, err := client.Discovery().ServerVersion(); err != nil {
+		return fmt.Errorf("kubernetes api %s is unreachable: %v", config.Host, err)
+	}
+	// version is usually served to anonymous users, resources are not
+	if _, err := client.Discovery().ServerResourcesForGroupVersion("v1"); err != nil {
+		return fmt.Errorf("kubernetes api %s rejected request: %v", config.Host, err)
+	}
+	return nil
+}
+
+// setReady marks application as ready, readiness is reported only while
+// kubernetes api is reachable and once synced returns true, synced can be nil
+func setReady(config *rest.Config, synced func() bool) error {
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	appStatus.Check = func() error {
+		if synced != nil && !synced() {
+			return errors.New("IP claims are not synced yet")
+		}
+		_, err := client.Discovery().ServerVersion()
+		return err
+	}
+	appStatus.SetReady()
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/rest"
+)
+
+func TestPreflight(t *testing.T) {
+	authorized := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/version":
+			w.Write([]byte(`{"major": "1", "minor": "7", "gitVersion": "v1.7.0"}`))
+		case !authorized:
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"kind": "Status", "apiVersion": "v1", "status": "Failure", "reason": "Unauthorized", "code": 401}`))
+		default:
+			w.Write([]byte(`{"kind": "APIResourceList", "groupVersion": "v1", "resources": []}`))
+		}
+	}))
+	defer server.Close()
+	config := &rest.Config{Host: server.URL}
+	assert.NoError(t, preflight(config))
+
+	authorized = false
+	err := preflight(config)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "rejected request")
+	}
+
+	defer func(skip bool) { AppOpts.NoPreflight = skip }(AppOpts.NoPreflight)
+	AppOpts.NoPreflight = true
+	assert.NoError(t, preflight(config), "Check should be skipped with no-preflight")
+	AppOpts.NoPreflight = false
+
+	server.Close()
+	err = preflight(config)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "is unreachable")
+	}
+}
+
+func TestServeAddressInUse(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+	err = serve("Health check", listener.Addr().String(), http.NewServeMux())
+	assert.Error(t, err, "Serving on a taken address must fail")
+}
@@ -0,0 +1,79 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/netutils"
+
+	"github.com/golang/glog"
+)
+
+// prepareIface creates dummy ifaces for external IPs if requested, iface
+// can be a comma separated list. Returned function removes ifaces that were
+// created here if their removal was requested
+func prepareIface(iface string) (func(), error) {
+	created := []string{}
+	cleanup := func() {
+		for _, link := range created {
+			if err := netutils.RemoveLink(link); err != nil {
+				glog.Errorf("Error removing link %v: %v", link, err)
+			}
+		}
+	}
+	if !AppOpts.CreateVIPIface {
+		return cleanup, nil
+	}
+	for _, link := range netutils.SplitIfaces(iface) {
+		if AppOpts.DryRun || AppOpts.Observer {
+			glog.Infof("dry-run: action=create-link iface=%s", link)
+			continue
+		}
+		isNew, err := netutils.EnsureDummyLink(link)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		if isNew && AppOpts.RemoveVIPIface {
+			created = append(created, link)
+		}
+	}
+	return cleanup, nil
+}
+
+// preflightNetlink fails if IPs can not be managed on this node, it is
+// skipped in modes that do not touch interfaces
+func preflightNetlink() error {
+	if AppOpts.NoPreflight || AppOpts.DryRun || AppOpts.Observer {
+		return nil
+	}
+	return netutils.CheckNetAdmin()
+}
+
+// stopOnSignal returns channel that is closed on SIGINT or SIGTERM
+func stopOnSignal() chan struct{} {
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		glog.V(0).Infof("Received %v, stopping", sig)
+		close(stop)
+	}()
+	return stop
+}
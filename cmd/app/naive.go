@@ -15,8 +15,6 @@
 package app
 
 import (
-	"os"
-
 	"github.com/golang/glog"
 	"github.com/spf13/cobra"
 	"k8s.io/client-go/rest"
@@ -43,25 +41,43 @@ func InitNaiveController() error {
 	mask := AppOpts.Mask
 
 	glog.V(4).Infof("Starting external ip controller using link: %s and mask: /%s", iface, mask)
-	stopCh := make(chan struct{})
-
-	var err error
 	var config *rest.Config
-	config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
 	if err != nil {
 		glog.Errorf("Error parsing config. %v", err)
 		return err
 	}
+	if err := serveDaemonEndpoints(); err != nil {
+		return err
+	}
+	if err := preflight(config); err != nil {
+		return err
+	}
+	if err := preflightNetlink(); err != nil {
+		return err
+	}
 
-	host, err := os.Hostname()
+	cleanup, err := prepareIface(iface)
 	if err != nil {
 		return err
 	}
+	defer cleanup()
+	stopCh := stopOnSignal()
 
-	c, err := externalip.NewExternalIpController(config, host, iface, mask, AppOpts.ResyncInterval)
+	host, err := AppOpts.NodeUID()
+	if err != nil {
+		return err
+	}
+
+	c, err := externalip.NewExternalIpController(config, host, iface, mask, AppOpts.ResyncInterval, ipHandler())
+	if err != nil {
+		return err
+	}
+	err = setReady(config, nil)
 	if err != nil {
 		return err
 	}
+	appStatus.SetAlive()
 	c.Run(stopCh)
 	return nil
 }
@@ -16,9 +16,16 @@ package app
 import (
 	"fmt"
 	"errors"
+	"net"
+	"os"
 	"strings"
 	"time"
 
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/claimcontroller"
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/extensions"
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/netutils"
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/scheduler"
+
 	"k8s.io/kubernetes/pkg/apis/componentconfig"
 	"k8s.io/kubernetes/pkg/client/leaderelection"
 
@@ -26,14 +33,61 @@ import (
 )
 
 type options struct {
-	Hostname          string
-	Iface             string
-	Kubeconfig        string
-	Mask              string
-	NodeFilter        string
+	NodeName           string
+	Hostname           string
+	Iface              string
+	Kubeconfig         string
+	Mask               string
+	NodeFilter         string
+	MetricsAddr        string
+	DryRun             bool
+	Observer           bool
+	Version            bool
+	IfaceAuto          bool
+	LeaseName          string
+	ReconcileOnStart   bool
+	ReconcilePeriod    time.Duration
+	MaxAssignRetries   int
+	CleanupConcurrency int
+	AssignWorkers      int
+	StartupJitter      time.Duration
+	GARPCount          int
+	HealthzAddr        string
+	NamespacedClaims   bool
+	ClaimsNamespace    string
+	CRDCreateRetries   int
+	SkipCRDManagement  bool
+	CRDGroup           string
+	CRDVersion         string
+	NoPreflight        bool
+	MaxIPsPerNode      int
+	FallbackNode       string
+	Pins               []string
+	PinAllowFallback   bool
+	ManagedCIDRs       []string
+	ExportConfigMap    string
+	ExportNamespace    string
+	AuditClaims        bool
+	WeighSubnets       bool
+	AssignMode         string
+	RouteTable         int
+	RouteSrcVIP        bool
+	PreAssignHook      string
+	PostAssignHook     string
+	HookTimeout        time.Duration
+	IfaceMAC           string
+	AddrScope          string
+	AddrNoPrefixRoute  bool
+	CreateVIPIface     bool
+	RemoveVIPIface     bool
+	AssignRateLimit    float64
+	DebugEndpoint      bool
+	RequireIfaceUp     bool
+	ExpectMTU          int
 
 	HeartbeatInterval time.Duration
 	MonitorInterval   time.Duration
+	ExportPeriod      time.Duration
 	ResyncInterval    time.Duration
 
 	LeaderElection componentconfig.LeaderElectionConfiguration
@@ -41,34 +95,140 @@ type options struct {
 
 var AppOpts = options{}
 
-var NodeFilters = []string{
-	"fair",
-	"first-alive",
-}
-
 func init() {
 	AppOpts.AddFlags(pflag.CommandLine)
 }
 
 func (o *options) AddFlags(fs *pflag.FlagSet) {
-	fs.StringVar(&o.Iface, "iface", "eth0", "Current interface will be used to assign ip addresses")
+	fs.StringVar(&o.Iface, "iface", "eth0", "Current interface will be used to assign ip addresses, comma separated list spreads IPs across interfaces")
+	fs.StringVar(&o.IfaceMAC, "iface-mac", "", "Hardware address of iface, IPs are assigned to a link with this address if iface is renamed")
+	fs.BoolVar(&o.IfaceAuto, "iface-auto", false, "Assign ip addresses to an interface from the same subnet, iface is used if there is no such interface")
 	fs.StringVar(&o.Mask, "mask", "32", "mask part of the cidr")
 	fs.StringVar(&o.Kubeconfig, "kubeconfig", "", "kubeconfig to use with kubernetes client")
+	fs.BoolVar(&o.NoPreflight, "no-preflight", false, "Do not check that kubernetes api is reachable and accepts credentials, and that IPs can be managed on start")
+	fs.StringVar(&o.NodeName, "node-name", "", "Name of the node used to identify it in claims, e.g. spec.nodeName from downward API. Takes precedence over hostname")
 	fs.StringVar(&o.Hostname, "hostname", "", "We will use os.Hostname if none provided")
-	filterList := strings.Join(NodeFilters, "|")
-	fs.StringVar(&o.NodeFilter, "nodefilter", NodeFilters[0], fmt.Sprintf("Possible values: %s. We will use '%s' if none was provided.", filterList, NodeFilters[0]))
+	filterList := strings.Join(scheduler.NodeFilterNames(), "|")
+	fs.StringVar(&o.NodeFilter, "nodefilter", scheduler.DefaultNodeFilter, fmt.Sprintf("Possible values: %s. We will use '%s' if none was provided.", filterList, scheduler.DefaultNodeFilter))
 	fs.DurationVar(&o.ResyncInterval, "resync", 20*time.Second, "Time to resync state for all ips")
 	fs.DurationVar(&o.HeartbeatInterval, "hb", 2*time.Second, "How often to send heartbeats from controllers?")
 	fs.DurationVar(&o.MonitorInterval, "monitor", 4*time.Second, "How often to check controllers liveness?")
+	fs.BoolVar(&o.ReconcileOnStart, "reconcile-on-start", true, "Remove addresses claimed by other nodes from iface when controller starts")
+	fs.DurationVar(&o.ReconcilePeriod, "reconcile-period", 5*time.Minute, "How often to add missing addresses of node claims and remove addresses claimed by other nodes, 0 disables it")
+	fs.IntVar(&o.MaxAssignRetries, "max-assign-retries", 5, "Number of consecutive failures after which IP claim is retried with exponential backoff, 0 retries it right away forever")
+	fs.IntVar(&o.CleanupConcurrency, "cleanup-concurrency", claimcontroller.DefaultCleanupConcurrency, "Maximum number of addresses removed in parallel when stale addresses are cleaned up")
+	fs.IntVar(&o.AssignWorkers, "assign-workers", 1, "Number of IP claims processed in parallel, claims of the same IP are never processed at once")
+	fs.DurationVar(&o.StartupJitter, "startup-jitter", 0, "Upper bound of a random delay, derived from node uid, before claims are processed on start, 0 disables it")
+	fs.IntVar(&o.GARPCount, "garp-count", netutils.DefaultGARPCount, "How many gratuitous ARP (or unsolicited NA for IPv6) packets to send for a new address")
+	fs.BoolVar(&o.NamespacedClaims, "namespaced-claims", false, "Create ipclaims and ipclaimpools as namespaced resources, they will be managed in claims-namespace only")
+	fs.StringVar(&o.ClaimsNamespace, "claims-namespace", "default", "Namespace of ipclaims and ipclaimpools")
+	fs.IntVar(&o.CRDCreateRetries, "crd-create-retries", extensions.DefaultCRDCreateRetries, "How many times to retry creation of custom resource definitions on transient api server errors")
+	fs.BoolVar(&o.SkipCRDManagement, "skip-crd-management", false, "Do not create custom resource definitions, only check that they are installed")
+	fs.StringVar(&o.CRDGroup, "crd-group", extensions.GroupName, "API group of custom resources")
+	fs.StringVar(&o.CRDVersion, "crd-version", extensions.Version, "API version of custom resources")
+	fs.IntVar(&o.MaxIPsPerNode, "max-ips-per-node", 0, "Maximum number of IPs scheduled on a single node, 0 means no limit")
+	fs.StringVar(&o.FallbackNode, "fallback-node", "", "IP node that accepts IPs which do not fit other live nodes, e.g. because of max-ips-per-node")
+	fs.StringSliceVar(&o.Pins, "pin", []string{}, "IPs that are scheduled only on a given IP node, as comma separated ip=node pairs")
+	fs.BoolVar(&o.PinAllowFallback, "pin-allow-fallback", false, "Schedule pinned IPs on other nodes while their node is not live")
+	fs.StringSliceVar(&o.ManagedCIDRs, "managed-cidr", []string{}, "Create IP claims only for service external IPs from these networks, can be repeated, empty means all IPs")
+	fs.StringVar(&o.ExportConfigMap, "export-configmap", "", "Config map that mirrors IP to node assignments for external tools, empty disables export")
+	fs.StringVar(&o.ExportNamespace, "export-configmap-namespace", "kube-system", "Namespace of export-configmap")
+	fs.DurationVar(&o.ExportPeriod, "export-period", 10*time.Second, "How often IP to node assignments are exported to export-configmap if they were changed")
+	fs.BoolVar(&o.AuditClaims, "audit-claims", false, "Record an event on services for every scheduled IP claim")
+	fs.BoolVar(&o.WeighSubnets, "weigh-subnets", true, "Count subnet IP claims by number of their addresses when balancing and limiting IPs per node")
+	fs.StringVar(&o.AssignMode, "assign-mode", netutils.AssignModeAddr, fmt.Sprintf("How to assign IPs to iface: %s - as addresses, %s - as local host routes for a routing daemon", netutils.AssignModeAddr, netutils.AssignModeRoute))
+	fs.IntVar(&o.RouteTable, "route-table", 0, "Routing table for IP routes in route assign mode, 0 means local table")
+	fs.BoolVar(&o.RouteSrcVIP, "route-src-vip", true, "Use external IP as preferred source address of its route in route assign mode")
+	fs.StringVar(&o.PreAssignHook, "pre-assign-hook", "", "Executable to run before IP is added or removed, the change is aborted if it fails")
+	fs.StringVar(&o.PostAssignHook, "post-assign-hook", "", "Executable to run after IP is added or removed, failures are only logged")
+	fs.DurationVar(&o.HookTimeout, "hook-timeout", 10*time.Second, "Maximum execution time of assign hooks, 0 means no limit")
+	fs.StringVar(&o.AddrScope, "addr-scope", "", "Scope of assigned addresses: global, site, link or host. Global scope is used if empty")
+	fs.BoolVar(&o.AddrNoPrefixRoute, "addr-noprefixroute", false, "Do not let kernel add a route to subnet of assigned addresses")
+	fs.BoolVar(&o.CreateVIPIface, "create-vip-iface", false, "Create iface as a dummy link if it does not exist")
+	fs.BoolVar(&o.RemoveVIPIface, "remove-vip-iface", false, "Remove iface on shutdown if it was created because of create-vip-iface")
+	fs.Float64Var(&o.AssignRateLimit, "assign-rate-limit", 0, "Maximum number of IP assignments per second, removals are not limited. 0 means no limit")
+	fs.BoolVar(&o.RequireIfaceUp, "require-iface-up", true, "Refuse to assign IPs to an interface that is down")
+	fs.IntVar(&o.ExpectMTU, "expect-mtu", 0, "Refuse to assign IPs to an interface with different MTU, 0 means any MTU")
+	fs.BoolVar(&o.DryRun, "dry-run", false, "Only log IP assignments and removals instead of changing interfaces")
+	fs.BoolVar(&o.Version, "version", false, "Print build version and exit")
+	fs.BoolVar(&o.Observer, "observer", false, "Watch claims and serve metrics without changing interfaces or writing to kubernetes API, changes are only logged")
+	fs.StringVar(&o.MetricsAddr, "metrics-addr", "", "Address to serve prometheus metrics on, e.g. ':9102'. Metrics are not served if empty")
+	fs.StringVar(&o.HealthzAddr, "healthz-addr", ":8080", "Address to serve /healthz and /readyz on. Health checks are not served if empty")
+	fs.BoolVar(&o.DebugEndpoint, "debug-endpoint", false, "Serve scheduler state as JSON on /debug/claims of healthz-addr")
+	fs.StringVar(&o.LeaseName, "leader-elect-lease-name", "ipclaim-scheduler", "Name of the endpoints object in kube-system namespace used as a leader election lock")
 	o.LeaderElection = leaderelection.DefaultLeaderElectionConfiguration()
 	leaderelection.BindFlags(&o.LeaderElection, fs)
 }
 
 func (o *options) CheckFlags() error {
-	for _, f := range NodeFilters {
+	if err := netutils.ValidateMask(o.Mask); err != nil {
+		return err
+	}
+	if o.AssignMode != netutils.AssignModeAddr && o.AssignMode != netutils.AssignModeRoute {
+		return fmt.Errorf("Incorrect assign mode '%v'", o.AssignMode)
+	}
+	if o.IfaceMAC != "" {
+		if _, err := net.ParseMAC(o.IfaceMAC); err != nil {
+			return err
+		}
+	}
+	if _, err := netutils.ParseAddrScope(o.AddrScope); err != nil {
+		return err
+	}
+	if o.MaxAssignRetries < 0 {
+		return fmt.Errorf("Incorrect max assign retries %d", o.MaxAssignRetries)
+	}
+	if o.CleanupConcurrency < 1 {
+		return fmt.Errorf("Incorrect cleanup concurrency %d", o.CleanupConcurrency)
+	}
+	if o.AssignWorkers < 1 {
+		return fmt.Errorf("Incorrect number of assign workers %d", o.AssignWorkers)
+	}
+	if !strings.Contains(o.CRDGroup, ".") {
+		return fmt.Errorf("Incorrect custom resources group '%v', it should contain a dot", o.CRDGroup)
+	}
+	if strings.TrimSpace(o.CRDVersion) == "" {
+		return errors.New("Custom resources version should not be empty")
+	}
+	if _, err := scheduler.ParsePins(o.Pins); err != nil {
+		return err
+	}
+	if _, err := netutils.ParseNetworks(o.ManagedCIDRs); err != nil {
+		return fmt.Errorf("Incorrect managed cidr: %v", err)
+	}
+	if o.ExportConfigMap != "" && o.ExportPeriod <= 0 {
+		return fmt.Errorf("Incorrect export period %v", o.ExportPeriod)
+	}
+	if o.RouteTable < 0 {
+		return fmt.Errorf("Incorrect route table %d", o.RouteTable)
+	}
+	for _, f := range scheduler.NodeFilterNames() {
 		if o.NodeFilter == f {
 			return nil
 		}
 	}
 	return errors.New("Incorrect node filter is provided")
-}
\ No newline at end of file
+}
+
+// overridden in tests
+var osHostname = os.Hostname
+
+// NodeUID returns name that identifies current node in claims. It is taken
+// from node-name, hostname or os.Hostname, whichever is set first
+func (o *options) NodeUID() (string, error) {
+	var err error
+	uid := o.NodeName
+	if strings.TrimSpace(uid) == "" {
+		uid = o.Hostname
+	}
+	if strings.TrimSpace(uid) == "" {
+		if uid, err = osHostname(); err != nil {
+			return "", err
+		}
+	}
+	uid = strings.ToLower(strings.TrimSpace(uid))
+	if uid == "" {
+		return "", errors.New("Node name is empty, it should be provided with node-name or hostname")
+	}
+	return uid, nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package app
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNodeUID(t *testing.T) {
+	defer func(f func() (string, error)) { osHostname = f }(osHostname)
+	osHostname = func() (string, error) { return "Pod-7f9c ", nil }
+
+	for _, tc := range []struct {
+		nodeName, hostname, expected string
+	}{
+		{"Node-1", "host-1", "node-1"},
+		{" ", "Host-1\n", "host-1"},
+		{"", "", "pod-7f9c"},
+	} {
+		o := options{NodeName: tc.nodeName, Hostname: tc.hostname}
+		uid, err := o.NodeUID()
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, uid, "Unexpected uid for node-name %q and hostname %q", tc.nodeName, tc.hostname)
+	}
+
+	osHostname = func() (string, error) { return " ", nil }
+	_, err := (&options{}).NodeUID()
+	assert.Error(t, err, "Empty uid should not be accepted")
+
+	osHostname = func() (string, error) { return "", errors.New("no hostname") }
+	_, err = (&options{}).NodeUID()
+	assert.Error(t, err)
+}
@@ -14,10 +14,109 @@
 
 package app
 
-import "github.com/spf13/cobra"
+import (
+	"net"
+	"time"
+
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/extensions"
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/netutils"
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/version"
+
+	"github.com/golang/glog"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/flowcontrol"
+)
 
 var Root = &cobra.Command{
 	Use:   "ipmanager",
 	Short: "Application to manage IPs assignment to k8s services",
-	Run:   func(cmd *cobra.Command, args []string) {},
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		glog.V(0).Infof("Starting ipmanager %s", version.String())
+		if AppOpts.CRDGroup != extensions.GroupName || AppOpts.CRDVersion != extensions.Version {
+			extensions.SetGroupVersion(AppOpts.CRDGroup, AppOpts.CRDVersion)
+		}
+		if AppOpts.NamespacedClaims {
+			extensions.SetNamespacedClaims(AppOpts.ClaimsNamespace)
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {},
+}
+
+// prepareCRDs creates CRDs and waits until they are established, CRDs are
+// only checked if they are managed by cluster administrator or in observer
+// mode
+func prepareCRDs(config *rest.Config) error {
+	if AppOpts.SkipCRDManagement || AppOpts.Observer {
+		return extensions.VerifyCRDsExist(config)
+	}
+	if err := extensions.EnsureCRDsExistWithRetries(config, AppOpts.CRDCreateRetries); err != nil {
+		return err
+	}
+	return extensions.WaitCRDsEstablished(config, 10*time.Second)
+}
+
+// ipHandler returns handler that will be used to manage IPs on a node
+func ipHandler() netutils.IPHandler {
+	return selectingIPHandler(linkIPHandler())
+}
+
+// linkIPHandler returns handler that manages IPs on a given link without
+// selecting links by iface list or subnets
+func linkIPHandler() netutils.IPHandler {
+	// validated by CheckFlags
+	ifaceMAC, _ := net.ParseMAC(AppOpts.IfaceMAC)
+	addrScope, _ := netutils.ParseAddrScope(AppOpts.AddrScope)
+	var handler netutils.IPHandler = netutils.LinuxIPHandler{
+		GARPCount: AppOpts.GARPCount,
+		AddrOptions: netutils.AddrOptions{
+			Scope:         addrScope,
+			NoPrefixRoute: AppOpts.AddrNoPrefixRoute,
+		},
+	}
+	if AppOpts.AssignMode == netutils.AssignModeRoute {
+		handler = netutils.RouteIPHandler{Table: AppOpts.RouteTable, SrcVIP: AppOpts.RouteSrcVIP}
+	}
+	if AppOpts.RequireIfaceUp || AppOpts.ExpectMTU != 0 {
+		handler = netutils.LinkCheckIPHandler{
+			Handler:   handler,
+			RequireUp: AppOpts.RequireIfaceUp,
+			ExpectMTU: AppOpts.ExpectMTU,
+		}
+	}
+	if AppOpts.PreAssignHook != "" || AppOpts.PostAssignHook != "" {
+		handler = &netutils.HookIPHandler{
+			Handler:  handler,
+			PreHook:  AppOpts.PreAssignHook,
+			PostHook: AppOpts.PostAssignHook,
+			Timeout:  AppOpts.HookTimeout,
+		}
+	}
+	if AppOpts.DryRun || AppOpts.Observer {
+		handler = netutils.DryRunIPHandler{}
+	} else {
+		handler = netutils.LinkWaitIPHandler{
+			Handler:      handler,
+			HardwareAddr: ifaceMAC,
+		}
+	}
+	if AppOpts.AssignRateLimit > 0 {
+		handler = netutils.RateLimitedIPHandler{
+			Handler: handler,
+			Limiter: flowcontrol.NewTokenBucketRateLimiter(float32(AppOpts.AssignRateLimit), 1),
+		}
+	}
+	return handler
+}
+
+// selectingIPHandler wraps handler, so IPs are spread across links of iface
+// list or assigned to links with the same subnet if requested
+func selectingIPHandler(handler netutils.IPHandler) netutils.IPHandler {
+	if len(netutils.SplitIfaces(AppOpts.Iface)) > 1 {
+		handler = netutils.MultiIfaceIPHandler{Handler: handler}
+	}
+	if AppOpts.IfaceAuto {
+		handler = netutils.AutoIfaceIPHandler{Handler: handler, ListAddrs: netutils.ListLinkAddrs}
+	}
+	return handler
 }
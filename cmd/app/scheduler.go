@@ -16,9 +16,9 @@ package app
 
 import (
 	"os"
-	"time"
 
 	"github.com/Mirantis/k8s-externalipcontroller/pkg/extensions"
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/netutils"
 	"github.com/Mirantis/k8s-externalipcontroller/pkg/scheduler"
 
 	"github.com/golang/glog"
@@ -55,22 +55,55 @@ func InitScheduler() error {
 		glog.Errorf("Error parsing config. %v", err)
 		os.Exit(1)
 	}
+	if err := serveDaemonEndpoints(); err != nil {
+		return err
+	}
+	if err := preflight(config); err != nil {
+		return err
+	}
 	stop := make(chan struct{})
 	s, err := scheduler.NewIPClaimScheduler(config, mask, AppOpts.MonitorInterval, AppOpts.NodeFilter)
 	if err != nil {
 		glog.Errorf("Crashed during scheduler initialization: %v", err)
 		os.Exit(2)
 	}
-	err = extensions.EnsureCRDsExist(config)
+	s.MaxClaimsPerNode = AppOpts.MaxIPsPerNode
+	s.FallbackNode = AppOpts.FallbackNode
+	s.AuditClaims = AppOpts.AuditClaims
+	s.WeighSubnets = AppOpts.WeighSubnets
+	s.PinAllowFallback = AppOpts.PinAllowFallback
+	// validated by CheckFlags
+	s.Pins, _ = scheduler.ParsePins(AppOpts.Pins)
+	s.ManagedNetworks, _ = netutils.ParseNetworks(AppOpts.ManagedCIDRs)
+	s.ExportConfigMap = AppOpts.ExportConfigMap
+	s.ExportNamespace = AppOpts.ExportNamespace
+	s.ExportPeriod = AppOpts.ExportPeriod
+	if AppOpts.Observer {
+		s.ExtensionsClientset = extensions.NewReadOnlyClientset(s.ExtensionsClientset)
+		s.Recorder = nil
+		s.Observer = true
+	}
+	if AppOpts.DebugEndpoint {
+		healthzMux.Handle("/debug/claims", s)
+	}
+	err = prepareCRDs(config)
 	if err != nil {
-		glog.Fatalf("Crashed while initializing third party resources: %v", err)
+		glog.Fatalf("Crashed while initializing custom resources: %v", err)
+	}
+	// observer never takes the lock, so it does not replace the leader
+	leaderElect := AppOpts.LeaderElection.LeaderElect && !AppOpts.Observer
+	// standby schedulers don't watch claims, so they are ready right away
+	var synced func() bool
+	if !leaderElect {
+		synced = s.HasSynced
 	}
-	err = extensions.WaitCRDsEstablished(config, 10*time.Second)
+	err = setReady(config, synced)
 	if err != nil {
-		glog.Fatalf("URLs for tprs are not registered: %v", err)
+		glog.Fatalf("Error creating readiness check: %v", err)
 	}
+	appStatus.SetAlive()
 
-	if !AppOpts.LeaderElection.LeaderElect {
+	if !leaderElect {
 		s.Run(stop)
 		os.Exit(0)
 	}
@@ -99,7 +132,7 @@ func InitScheduler() error {
 	rl := resourcelock.EndpointsLock{
 		EndpointsMeta: api.ObjectMeta{
 			Namespace: "kube-system",
-			Name:      "ipclaim-scheduler",
+			Name:      AppOpts.LeaseName,
 		},
 		Client: leaderElectionClient,
 		LockConfig: resourcelock.ResourceLockConfig{
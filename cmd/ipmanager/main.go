@@ -16,14 +16,20 @@ package main
 
 import (
 	"log"
+	"os"
 
 	"github.com/Mirantis/k8s-externalipcontroller/cmd/app"
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/version"
 
 	"k8s.io/kubernetes/pkg/util/flag"
 )
 
 func main() {
 	flag.InitFlags()
+	if app.AppOpts.Version {
+		version.Fprint(os.Stdout)
+		os.Exit(0)
+	}
 	if err := app.AppOpts.CheckFlags(); err != nil {
 		log.Fatal(err)
 	}
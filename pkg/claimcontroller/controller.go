@@ -15,10 +15,16 @@
 package claimcontroller
 
 import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Mirantis/k8s-externalipcontroller/pkg/extensions"
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/metrics"
 	"github.com/Mirantis/k8s-externalipcontroller/pkg/netutils"
 	"github.com/Mirantis/k8s-externalipcontroller/pkg/workqueue"
 
@@ -28,11 +34,36 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/pkg/api"
+	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 )
 
-func NewClaimController(iface, uid string, config *rest.Config, resyncInterval time.Duration, hbInterval time.Duration) (*claimController, error) {
+// queueReportPeriod is how often queue metrics are updated
+const queueReportPeriod = 5 * time.Second
+
+// DefaultCleanupConcurrency is how many addresses are removed in parallel
+// by default
+const DefaultCleanupConcurrency = 4
+
+// ClaimQuarantinedReason is a reason of events emitted when assignment of
+// a claim keeps failing and it is retried with backoff
+const ClaimQuarantinedReason = "IPClaimQuarantined"
+
+// LinkMissingReason is a reason of events emitted when IP of a claim can not
+// be assigned because its link does not exist
+const LinkMissingReason = "IPLinkMissing"
+
+// NormalizeUid returns node uid as it is used in IP claims, dots are
+// replaced because uid is a name of IpNode object
+func NormalizeUid(uid string) string {
+	return strings.Replace(uid, ".", "-", -1)
+}
+
+func NewClaimController(iface, uid string, config *rest.Config, resyncInterval time.Duration, hbInterval time.Duration, iphandler netutils.IPHandler) (*claimController, error) {
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		return nil, err
@@ -51,17 +82,26 @@ func NewClaimController(iface, uid string, config *rest.Config, resyncInterval t
 		},
 	}
 	queue := workqueue.NewQueue()
-	uid = strings.Replace(uid, ".", "-", -1)
+	uid = NormalizeUid(uid)
+
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(glog.Infof)
+	eventBroadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: clientset.Core().Events("")})
+	recorder := eventBroadcaster.NewRecorder(api.Scheme, v1.EventSource{Component: "ipclaim-controller", Host: uid})
 	return &claimController{
 		Clientset:           clientset,
 		ExtensionsClientset: ext,
 		Iface:               iface,
 		Uid:                 uid,
+		Recorder:            recorder,
 		claimSource:         claimSource,
 		queue:               queue,
-		iphandler:           netutils.LinuxIPHandler{},
+		iphandler:           iphandler,
 		heartbeatPeriod:     hbInterval,
 		resyncInterval:      resyncInterval,
+		listAddrs:           netutils.ListLinkAddrs,
+		listRoutes:          netutils.ListLocalRoutes,
+		checkLink:           netutils.CheckLink,
 	}, nil
 }
 
@@ -71,6 +111,33 @@ type claimController struct {
 	// i am not sure that it should be configurable for controller
 	Iface string
 	Uid   string
+	// ReconcileOnStart removes addresses claimed by other nodes from Iface
+	// before processing claims
+	ReconcileOnStart bool
+	// ReconcilePeriod is how often addresses on Iface are compared with
+	// claims, 0 disables periodic reconciliation
+	ReconcilePeriod time.Duration
+	// MaxAssignRetries is a number of consecutive failures after which
+	// claim is retried with backoff, 0 means that claim is retried
+	// right away
+	MaxAssignRetries int
+	Recorder         record.EventRecorder
+	// StartupJitter is an upper bound of a delay before claims are
+	// processed, so nodes restarted together do not reclaim IPs at once
+	StartupJitter time.Duration
+	// CleanupConcurrency limits number of addresses removed in parallel
+	// during reconciliation, DefaultCleanupConcurrency is used if it is 0
+	CleanupConcurrency int
+	// LinkIPHandler manages IPs of claims that set their link, it should
+	// not select links itself. IP handler of controller is used if it is nil
+	LinkIPHandler netutils.IPHandler
+	// AssignWorkers is a number of workers processing claims in parallel,
+	// claims of the same cidr are never processed at once. One worker is
+	// started if it is 0
+	AssignWorkers int
+	// RouteTable is a routing table where IP handler installs routes,
+	// only routes in this table are reconciled. Local table is used if 0
+	RouteTable int
 
 	claimSource cache.ListerWatcher
 	claimStore  cache.Store
@@ -82,16 +149,64 @@ type claimController struct {
 	heartbeatPeriod time.Duration
 
 	resyncInterval time.Duration
+
+	listAddrs  func() ([]netutils.LinkAddr, error)
+	listRoutes func(table int) ([]netutils.LinkAddr, error)
+	checkLink  func(string) error
+
+	timer      assignTimer
+	quarantine quarantine
+	inflight   inflight
+
+	// synced is set to 1 once claims are listed for the first time
+	synced int32
 }
 
 func (c *claimController) Run(stop chan struct{}) {
-	go c.worker()
+	if !c.waitStartupJitter(stop) {
+		return
+	}
+	if c.ReconcileOnStart {
+		if err := c.reconcileLinkAddrs(); err != nil {
+			glog.Errorf("Error reconciling addresses on link %v: %v", c.Iface, err)
+		}
+	}
+	if c.ReconcilePeriod > 0 {
+		go c.reconcileLoop(stop, time.Tick(c.ReconcilePeriod))
+	}
+	for i := 0; i < c.AssignWorkers || i == 0; i++ {
+		go c.worker()
+	}
+	go c.queueMonitor(stop, time.Tick(queueReportPeriod))
 	go c.claimWatcher(stop)
 	go c.heartbeatIpNode(stop, time.Tick(c.heartbeatPeriod))
 	<-stop
 	c.queue.Close()
 }
 
+// waitStartupJitter sleeps for a random time below StartupJitter, the delay
+// is derived from node uid so it is the same across restarts of a node and
+// differs between nodes. It returns false if stop was closed while waiting
+func (c *claimController) waitStartupJitter(stop chan struct{}) bool {
+	if c.StartupJitter <= 0 {
+		return true
+	}
+	delay := startupDelay(c.Uid, c.StartupJitter)
+	glog.V(3).Infof("Delaying start by %v", delay)
+	select {
+	case <-stop:
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
+
+func startupDelay(uid string, jitter time.Duration) time.Duration {
+	h := fnv.New64a()
+	h.Write([]byte(uid))
+	return time.Duration(rand.New(rand.NewSource(int64(h.Sum64()))).Int63n(int64(jitter)))
+}
+
 func (c *claimController) claimWatcher(stop chan struct{}) {
 	store, controller := cache.NewInformer(
 		c.claimSource,
@@ -102,6 +217,7 @@ func (c *claimController) claimWatcher(stop chan struct{}) {
 				claim := obj.(*extensions.IpClaim)
 				glog.V(3).Infof("Received add event for ipclaim %v - %v - %v",
 					claim.Metadata.Name, claim.Spec.NodeName, claim.Metadata.ResourceVersion)
+				c.observe(claim)
 				c.queue.Add(claim)
 			},
 			UpdateFunc: func(old, cur interface{}) {
@@ -110,6 +226,7 @@ func (c *claimController) claimWatcher(stop chan struct{}) {
 				glog.V(3).Infof("Received update event. Old ipclaim %v - %v, New ipclaim %v - %v -%v",
 					oldClaim.Metadata.Name, oldClaim.Spec.NodeName,
 					curClaim.Metadata.Name, curClaim.Spec.NodeName, curClaim.Metadata.ResourceVersion)
+				c.observe(curClaim)
 				c.queue.Add(curClaim)
 			},
 			DeleteFunc: func(obj interface{}) {
@@ -121,35 +238,362 @@ func (c *claimController) claimWatcher(stop chan struct{}) {
 		},
 	)
 	c.claimStore = store
+	go func() {
+		if cache.WaitForCacheSync(stop, controller.HasSynced) {
+			glog.V(3).Infof("Claims are synced")
+			atomic.StoreInt32(&c.synced, 1)
+		}
+	}()
 	controller.Run(stop)
 }
 
+// HasSynced returns true once all claims are listed and processed by the
+// claim watcher
+func (c *claimController) HasSynced() bool {
+	return atomic.LoadInt32(&c.synced) == 1
+}
+
 func (c *claimController) worker() {
 	for {
 		item, quit := c.queue.Get()
 		if quit {
 			return
 		}
-		err := c.processClaim(item.(*extensions.IpClaim))
-		if err != nil {
+		c.reportQueue()
+		ipclaim := item.(*extensions.IpClaim)
+		if !c.inflight.start(ipclaim.Spec.Cidr, item) {
+			// requeued by the worker that processes this cidr now
+			c.queue.Done(item)
+			continue
+		}
+		err := c.processClaim(ipclaim)
+		if err == nil {
+			c.quarantine.succeeded(ipclaim.Spec.Cidr)
+		} else if delay, quarantined := c.quarantine.failed(ipclaim.Spec.Cidr, c.MaxAssignRetries); quarantined {
+			glog.Errorf("Error processing claim %v, retrying in %v: %v", ipclaim.Metadata.Name, delay, err)
+			if c.Recorder != nil {
+				c.Recorder.Eventf(ipclaim, v1.EventTypeWarning, ClaimQuarantinedReason,
+					"Failed to process IP %s on node %s, retrying in %v: %v", ipclaim.Spec.Cidr, c.Uid, delay, err)
+			}
+			time.AfterFunc(delay, func() { c.requeueQuarantined(ipclaim) })
+		} else {
 			glog.Errorf("Error processing claim %v", err)
 			c.queue.Add(item)
 		}
 		c.queue.Done(item)
+		if pending := c.inflight.finish(ipclaim.Spec.Cidr); pending != nil {
+			c.queue.Add(pending)
+		}
+	}
+}
+
+// requeueQuarantined queues claim once its quarantine is over. Claim is
+// queued only if it was not changed meanwhile, newer versions are queued
+// by the claim watcher and the stale one would undo them, e.g. assign IP
+// that was moved to another node
+func (c *claimController) requeueQuarantined(ipclaim *extensions.IpClaim) {
+	latest, exists, err := c.claimStore.Get(ipclaim)
+	if err != nil || !exists {
+		glog.V(3).Infof("Claim %v was removed during quarantine, retry is dropped", ipclaim.Metadata.Name)
+		return
 	}
+	if latest.(*extensions.IpClaim).Metadata.ResourceVersion != ipclaim.Metadata.ResourceVersion {
+		glog.V(3).Infof("Claim %v was updated during quarantine, retry is dropped", ipclaim.Metadata.Name)
+		return
+	}
+	c.queue.Add(latest)
+}
+
+// queueMonitor reports queue metrics periodically, so they are up to date
+// even if worker is stuck on a slow claim
+func (c *claimController) queueMonitor(stop chan struct{}, ticker <-chan time.Time) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker:
+			c.reportQueue()
+		}
+	}
+}
+
+func (c *claimController) reportQueue() {
+	metrics.AssignQueueLength.Set(float64(c.queue.Len()))
+	metrics.AssignQueueOldestAge.Set(c.queue.OldestAge().Seconds())
+}
+
+// observe starts assignment timer for claims that are scheduled on this
+// node and not yet assigned
+func (c *claimController) observe(ipclaim *extensions.IpClaim) {
+	if ipclaim.Spec.NodeName == c.Uid && ipclaim.Metadata.DeletionTimestamp == nil && !c.isMarkedAssigned(ipclaim) {
+		c.timer.start(ipclaim.Spec.Cidr)
+	}
+}
+
+// observeAssigned reports time passed since the claim was observed, claims
+// that were assigned on some node before are counted as reclaims
+func (c *claimController) observeAssigned(ipclaim *extensions.IpClaim) {
+	latency, exists := c.timer.stop(ipclaim.Spec.Cidr)
+	if !exists {
+		return
+	}
+	kind := metrics.AssignInitial
+	if ipclaim.WasAssigned() {
+		kind = metrics.AssignReclaim
+	}
+	glog.V(5).Infof("IP %v was assigned in %v (%v)", ipclaim.Spec.Cidr, latency, kind)
+	metrics.AssignLatency.WithLabelValues(kind).Observe(latency.Seconds())
 }
 
 func (c *claimController) processClaim(ipclaim *extensions.IpClaim) error {
 	glog.V(5).Infof("Processing claim %v with node %v and uid %v",
 		ipclaim.Spec.Cidr, ipclaim.Spec.NodeName, c.Uid)
 	if _, exists, _ := c.claimStore.Get(ipclaim); !exists {
-		return c.iphandler.Del(c.Iface, ipclaim.Spec.Cidr)
+		c.timer.forget(ipclaim.Spec.Cidr)
+		return c.delIP(ipclaim)
+	}
+	if ipclaim.Metadata.DeletionTimestamp != nil {
+		c.timer.forget(ipclaim.Spec.Cidr)
+		if err := c.delIP(ipclaim); err != nil {
+			return err
+		}
+		if ipclaim.Spec.NodeName != c.Uid || !ipclaim.HasFinalizer() {
+			return nil
+		}
+		return c.updateClaim(ipclaim.Metadata.Name, func(latest *extensions.IpClaim) bool {
+			if !latest.HasFinalizer() {
+				return false
+			}
+			latest.RemoveFinalizer()
+			return true
+		})
 	}
 	if ipclaim.Spec.NodeName == c.Uid {
-		return c.iphandler.Add(c.Iface, ipclaim.Spec.Cidr)
+		if err := c.addIP(ipclaim); err != nil {
+			if netutils.IsLinkMissing(err) && c.Recorder != nil {
+				c.Recorder.Eventf(ipclaim, v1.EventTypeWarning, LinkMissingReason,
+					"IP %s is not assigned on node %s until link appears: %v", ipclaim.Spec.Cidr, c.Uid, err)
+			}
+			return err
+		}
+		c.observeAssigned(ipclaim)
+		if c.isMarkedAssigned(ipclaim) {
+			return nil
+		}
+		return c.updateClaim(ipclaim.Metadata.Name, c.markAssigned)
 	} else {
+		c.timer.forget(ipclaim.Spec.Cidr)
+		return c.delIP(ipclaim)
+	}
+}
+
+// isMarkedAssigned returns true if claim has cleanup finalizer and its
+// status shows that IP is assigned on this node
+func (c *claimController) isMarkedAssigned(ipclaim *extensions.IpClaim) bool {
+	return ipclaim.HasFinalizer() &&
+		ipclaim.Status.State == extensions.IpClaimAssigned &&
+		ipclaim.Status.NodeName == c.Uid
+}
+
+// markAssigned sets cleanup finalizer and assigned status of a claim,
+// it returns false if claim is already up to date
+func (c *claimController) markAssigned(ipclaim *extensions.IpClaim) bool {
+	if ipclaim.Spec.NodeName != c.Uid || c.isMarkedAssigned(ipclaim) {
+		return false
+	}
+	if !ipclaim.HasFinalizer() {
+		ipclaim.Metadata.Finalizers = append(ipclaim.Metadata.Finalizers, extensions.IpClaimFinalizer)
+	}
+	ipclaim.Status = extensions.IpClaimStatus{
+		NodeName:   c.Uid,
+		AssignedAt: metav1.Now(),
+		State:      extensions.IpClaimAssigned,
+	}
+	return true
+}
+
+// updateClaim applies change to the latest version of a claim and saves it
+// if change returns true
+func (c *claimController) updateClaim(name string, change func(*extensions.IpClaim) bool) error {
+	ipclaim, err := c.ExtensionsClientset.IPClaims().Get(name)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !change(ipclaim) {
+		return nil
+	}
+	glog.V(3).Infof("Updating ipclaim %v. Finalizers %v, status %v",
+		name, ipclaim.Metadata.Finalizers, ipclaim.Status)
+	_, err = c.ExtensionsClientset.IPClaims().Update(ipclaim)
+	return err
+}
+
+func (c *claimController) reconcileLoop(stop chan struct{}, ticker <-chan time.Time) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker:
+			if err := c.reconcileLinkAddrs(); err != nil {
+				glog.Errorf("Error reconciling addresses on link %v: %v", c.Iface, err)
+			}
+		}
+	}
+}
+
+// reconcileLinkAddrs removes addresses and local routes that were left on
+// a link after restart or missed watch events while their claims were moved
+// to other nodes, and adds IPs of this node claims that are missing on all
+// links. Addresses and routes that are not claimed at all are not touched,
+// so node own addresses are preserved
+func (c *claimController) reconcileLinkAddrs() error {
+	claims, err := c.ExtensionsClientset.IPClaims().List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	addrs, err := c.listAddrs()
+	if err != nil {
+		return err
+	}
+	// IPs assigned in route mode and subnets are installed as routes,
+	// routes in other tables are not managed by controller
+	routes, err := c.listRoutes(c.RouteTable)
+	if err != nil {
+		return err
+	}
+	owners := make(map[string]string, len(claims.Items))
+	routeOwners := make(map[string]string, len(claims.Items))
+	for _, claim := range claims.Items {
+		owners[claim.Spec.Cidr] = claim.Spec.NodeName
+		if dst, err := netutils.RouteDst(claim.Spec.Cidr); err == nil {
+			routeOwners[dst.String()] = claim.Spec.NodeName
+		}
+	}
+	present := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		present[addr.Network.String()] = true
+	}
+	routed := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		routed[route.Network.String()] = true
+	}
+	added, removed := 0, 0
+	for _, claim := range claims.Items {
+		if claim.Spec.NodeName != c.Uid || claim.Metadata.DeletionTimestamp != nil || present[claim.Spec.Cidr] {
+			continue
+		}
+		if dst, err := netutils.RouteDst(claim.Spec.Cidr); err == nil && routed[dst.String()] {
+			continue
+		}
+		glog.V(2).Infof("IP %v of claim %v is missing, adding it", claim.Spec.Cidr, claim.Metadata.Name)
+		if err := c.addIP(&claim); err != nil {
+			return err
+		}
+		added++
+	}
+	ifaces := map[string]bool{}
+	for _, iface := range netutils.SplitIfaces(c.Iface) {
+		ifaces[iface] = true
+	}
+	// links set by claims are managed as well, even if they are not in Iface
+	for _, claim := range claims.Items {
+		if claim.Spec.Link != "" {
+			ifaces[claim.Spec.Link] = true
+		}
+	}
+	foreign := []netutils.LinkAddr{}
+	for _, addr := range addrs {
+		if !ifaces[addr.Link] {
+			continue
+		}
+		cidr := addr.Network.String()
+		node, claimed := owners[cidr]
+		if !claimed || node == c.Uid {
+			continue
+		}
+		glog.V(2).Infof("Address %v on link %v is claimed by node %v, removing it", cidr, addr.Link, node)
+		foreign = append(foreign, addr)
+	}
+	for _, route := range routes {
+		if !ifaces[route.Link] {
+			continue
+		}
+		dst := route.Network.String()
+		node, claimed := routeOwners[dst]
+		if !claimed || node == c.Uid {
+			continue
+		}
+		glog.V(2).Infof("Route %v on link %v is claimed by node %v, removing it", dst, route.Link, node)
+		foreign = append(foreign, route)
+	}
+	if err := c.removeAddrs(foreign); err != nil {
+		return err
+	}
+	removed = len(foreign)
+	if added != 0 || removed != 0 {
+		glog.Infof("Reconciled IPs on link %v: %d added, %d removed", c.Iface, added, removed)
+	} else {
+		glog.V(3).Infof("IPs on link %v match claims", c.Iface)
+	}
+	return nil
+}
+
+// addIP assigns IP of a claim to its link if it is set, otherwise IP handler
+// selects a link from Iface. Link of a claim is expected to exist
+func (c *claimController) addIP(ipclaim *extensions.IpClaim) error {
+	if ipclaim.Spec.Link == "" {
+		return c.iphandler.Add(c.Iface, ipclaim.Spec.Cidr)
+	}
+	if err := c.checkLink(ipclaim.Spec.Link); err != nil {
+		return fmt.Errorf("link %s of claim %s is not available: %v", ipclaim.Spec.Link, ipclaim.Metadata.Name, err)
+	}
+	return c.linkIPHandler().Add(ipclaim.Spec.Link, ipclaim.Spec.Cidr)
+}
+
+// delIP removes IP of a claim from the link it was assigned to
+func (c *claimController) delIP(ipclaim *extensions.IpClaim) error {
+	if ipclaim.Spec.Link == "" {
 		return c.iphandler.Del(c.Iface, ipclaim.Spec.Cidr)
 	}
+	return c.linkIPHandler().Del(ipclaim.Spec.Link, ipclaim.Spec.Cidr)
+}
+
+func (c *claimController) linkIPHandler() netutils.IPHandler {
+	if c.LinkIPHandler != nil {
+		return c.LinkIPHandler
+	}
+	return c.iphandler
+}
+
+// removeAddrs removes addresses with at most CleanupConcurrency parallel
+// calls to ip handler, so removal of many addresses or routes does not
+// overload netlink socket. First error is returned after all calls finish
+func (c *claimController) removeAddrs(addrs []netutils.LinkAddr) error {
+	concurrency := c.CleanupConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultCleanupConcurrency
+	}
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+	slots := make(chan struct{}, concurrency)
+	for _, addr := range addrs {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(link, cidr string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			// address is removed from the link where it was found
+			if err := c.linkIPHandler().Del(link, cidr); err != nil {
+				errOnce.Do(func() { firstErr = err })
+			}
+		}(addr.Link, addr.Network.String())
+	}
+	wg.Wait()
+	return firstErr
 }
 
 func (c *claimController) heartbeatIpNode(stop chan struct{}, ticker <-chan time.Time) {
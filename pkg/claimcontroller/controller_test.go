@@ -15,21 +15,29 @@
 package claimcontroller
 
 import (
+	"fmt"
+	"net"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/Mirantis/k8s-externalipcontroller/pkg/extensions"
 	fclient "github.com/Mirantis/k8s-externalipcontroller/pkg/extensions/testing"
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/metrics"
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/netutils"
 	"github.com/Mirantis/k8s-externalipcontroller/pkg/workqueue"
 
 	"github.com/Mirantis/k8s-externalipcontroller/pkg/utils"
 
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
 	fcache "k8s.io/client-go/tools/cache/testing"
+	"k8s.io/client-go/tools/record"
 )
 
 type fakeIpHandler struct {
@@ -62,13 +70,19 @@ func TestClaimWatcher(t *testing.T) {
 		queue:               queue,
 		iphandler:           fiphandler,
 	}
+	assert.False(t, c.HasSynced(), "Claims should not be synced before watcher starts")
 	go c.claimWatcher(stop)
 	go c.worker()
+	utils.EventualCondition(t, time.Second*1, func() bool {
+		return c.HasSynced()
+	}, "Claims should be synced after initial list")
 	claim := &extensions.IpClaim{
 		Metadata: metav1.ObjectMeta{Name: "10.10.0.2-24"},
 		Spec:     extensions.IpClaimSpec{Cidr: "10.10.0.2/24", NodeName: "first"},
 	}
 	fiphandler.On("Add", c.Iface, claim.Spec.Cidr).Return(nil)
+	ext.Ipclaims.On("Get", claim.Metadata.Name).Return(claim, nil)
+	ext.Ipclaims.On("Update", mock.Anything).Return(nil)
 	lw.Add(claim)
 	utils.EventualCondition(t, time.Second*1, func() bool {
 		return assert.ObjectsAreEqual(1, len(fiphandler.Calls))
@@ -112,3 +126,645 @@ func TestHeartbeatIpNode(t *testing.T) {
 		return assert.ObjectsAreEqual(6, len(ext.Ipnodes.Calls))
 	}, "Unexpect calls to iphandler", ext.Ipnodes.Calls)
 }
+
+func TestReconcileLinkAddrs(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	fiphandler := &fakeIpHandler{}
+	c := claimController{
+		Uid:                 "first",
+		Iface:               "eth0",
+		ExtensionsClientset: ext,
+		iphandler:           fiphandler,
+		listRoutes:          noRoutes,
+		listAddrs: func() ([]netutils.LinkAddr, error) {
+			addrs := []netutils.LinkAddr{}
+			for _, a := range []struct{ link, cidr string }{
+				{"eth0", "192.168.0.5/24"},
+				{"eth0", "10.10.0.2/32"},
+				{"eth0", "10.10.0.3/32"},
+				{"eth1", "10.10.0.4/32"},
+			} {
+				ip, network, _ := net.ParseCIDR(a.cidr)
+				network.IP = ip
+				addrs = append(addrs, netutils.LinkAddr{Link: a.link, Network: network})
+			}
+			return addrs, nil
+		},
+	}
+	claims := &extensions.IpClaimList{Items: []extensions.IpClaim{
+		{Spec: extensions.IpClaimSpec{Cidr: "10.10.0.2/32", NodeName: "first"}},
+		{Spec: extensions.IpClaimSpec{Cidr: "10.10.0.3/32", NodeName: "second"}},
+		{Spec: extensions.IpClaimSpec{Cidr: "10.10.0.4/32", NodeName: "second"}},
+	}}
+	ext.Ipclaims.On("List", mock.Anything).Return(claims, nil)
+	fiphandler.On("Del", "eth0", "10.10.0.3/32").Return(nil)
+
+	assert.NoError(t, c.reconcileLinkAddrs())
+	fiphandler.AssertExpectations(t)
+	assert.Len(t, fiphandler.Calls, 1, "Only address claimed by other node on iface should be removed")
+}
+
+func noRoutes(table int) ([]netutils.LinkAddr, error) {
+	return nil, nil
+}
+
+func TestReconcileLinkRoutes(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	fiphandler := &fakeIpHandler{}
+	c := claimController{
+		Uid:                 "first",
+		Iface:               "lo",
+		ExtensionsClientset: ext,
+		iphandler:           fiphandler,
+		listAddrs: func() ([]netutils.LinkAddr, error) {
+			return nil, nil
+		},
+		listRoutes: func(table int) ([]netutils.LinkAddr, error) {
+			routes := []netutils.LinkAddr{}
+			for _, cidr := range []string{"10.10.0.2/32", "10.10.0.3/32", "10.20.0.0/24"} {
+				_, network, _ := net.ParseCIDR(cidr)
+				routes = append(routes, netutils.LinkAddr{Link: "lo", Network: network})
+			}
+			return routes, nil
+		},
+	}
+	claims := &extensions.IpClaimList{Items: []extensions.IpClaim{
+		// route mode installs host route regardless of claim mask
+		{Spec: extensions.IpClaimSpec{Cidr: "10.10.0.2/24", NodeName: "first"}},
+		{Spec: extensions.IpClaimSpec{Cidr: "10.10.0.3/32", NodeName: "second"}},
+		{Spec: extensions.IpClaimSpec{Cidr: "10.20.0.0/24", NodeName: "first"}},
+	}}
+	ext.Ipclaims.On("List", mock.Anything).Return(claims, nil)
+	fiphandler.On("Del", "lo", "10.10.0.3/32").Return(nil)
+
+	assert.NoError(t, c.reconcileLinkAddrs())
+	fiphandler.AssertExpectations(t)
+	assert.Len(t, fiphandler.Calls, 1, "Routes of this node claims should not be added again")
+}
+
+func TestReconcileClaimLink(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	fiphandler := &fakeIpHandler{}
+	c := claimController{
+		Uid:                 "first",
+		Iface:               "eth0",
+		ExtensionsClientset: ext,
+		iphandler:           fiphandler,
+		listAddrs: func() ([]netutils.LinkAddr, error) {
+			addrs := []netutils.LinkAddr{}
+			for _, cidr := range []string{"10.10.0.2/32", "10.10.0.3/32"} {
+				_, network, _ := net.ParseCIDR(cidr)
+				addrs = append(addrs, netutils.LinkAddr{Link: "eth1", Network: network})
+			}
+			return addrs, nil
+		},
+		listRoutes: noRoutes,
+	}
+	claims := &extensions.IpClaimList{Items: []extensions.IpClaim{
+		{Spec: extensions.IpClaimSpec{Cidr: "10.10.0.2/32", NodeName: "first", Link: "eth1"}},
+		{Spec: extensions.IpClaimSpec{Cidr: "10.10.0.3/32", NodeName: "second", Link: "eth1"}},
+	}}
+	ext.Ipclaims.On("List", mock.Anything).Return(claims, nil)
+	fiphandler.On("Del", "eth1", "10.10.0.3/32").Return(nil)
+
+	assert.NoError(t, c.reconcileLinkAddrs())
+	fiphandler.AssertExpectations(t)
+	assert.Len(t, fiphandler.Calls, 1, "Addresses on links of claims should be reconciled")
+}
+
+func TestReconcileRouteTable(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	fiphandler := &fakeIpHandler{}
+	tables := []int{}
+	c := claimController{
+		Uid:                 "first",
+		Iface:               "lo",
+		RouteTable:          100,
+		ExtensionsClientset: ext,
+		iphandler:           fiphandler,
+		listAddrs: func() ([]netutils.LinkAddr, error) {
+			return nil, nil
+		},
+		listRoutes: func(table int) ([]netutils.LinkAddr, error) {
+			tables = append(tables, table)
+			if table != 100 {
+				return nil, nil
+			}
+			_, network, _ := net.ParseCIDR("10.10.0.3/32")
+			return []netutils.LinkAddr{{Link: "lo", Network: network}}, nil
+		},
+	}
+	claims := &extensions.IpClaimList{Items: []extensions.IpClaim{
+		{Spec: extensions.IpClaimSpec{Cidr: "10.10.0.3/32", NodeName: "second"}},
+	}}
+	ext.Ipclaims.On("List", mock.Anything).Return(claims, nil)
+	fiphandler.On("Del", "lo", "10.10.0.3/32").Return(nil)
+
+	assert.NoError(t, c.reconcileLinkAddrs())
+	assert.Equal(t, []int{100}, tables, "Only routes in configured table should be listed")
+	fiphandler.AssertExpectations(t)
+}
+
+// countingIpHandler tracks the highest number of concurrent Del calls and
+// Del calls that overlapped for the same cidr
+type countingIpHandler struct {
+	sync.Mutex
+	inflight, maxInflight, calls, overlaps int
+	active                                 map[string]bool
+}
+
+func (h *countingIpHandler) Add(iface, cidr string) error {
+	return nil
+}
+
+func (h *countingIpHandler) Del(iface, cidr string) error {
+	h.Lock()
+	h.inflight++
+	h.calls++
+	if h.inflight > h.maxInflight {
+		h.maxInflight = h.inflight
+	}
+	if h.active == nil {
+		h.active = map[string]bool{}
+	}
+	if h.active[cidr] {
+		h.overlaps++
+	}
+	h.active[cidr] = true
+	h.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	h.Lock()
+	h.inflight--
+	delete(h.active, cidr)
+	h.Unlock()
+	return nil
+}
+
+func (h *countingIpHandler) Calls() int {
+	h.Lock()
+	defer h.Unlock()
+	return h.calls
+}
+
+func TestRemoveAddrsConcurrency(t *testing.T) {
+	handler := &countingIpHandler{}
+	c := claimController{iphandler: handler, CleanupConcurrency: 2}
+	addrs := []netutils.LinkAddr{}
+	for _, cidr := range []string{"10.10.0.2/32", "10.10.0.3/32", "10.10.0.4/32", "10.10.0.5/32"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		addrs = append(addrs, netutils.LinkAddr{Link: "eth0", Network: network})
+	}
+	assert.NoError(t, c.removeAddrs(addrs))
+	assert.Equal(t, 4, handler.calls)
+	assert.Equal(t, 2, handler.maxInflight, "At most 2 addresses should be removed at once")
+}
+
+func TestAssignWorkers(t *testing.T) {
+	queue := workqueue.NewQueue()
+	defer queue.Close()
+	handler := &countingIpHandler{}
+	c := claimController{
+		Uid:           "first",
+		Iface:         "eth0",
+		AssignWorkers: 4,
+		claimStore:    cache.NewStore(cache.MetaNamespaceKeyFunc),
+		queue:         queue,
+		iphandler:     handler,
+	}
+	for i, cidr := range []string{"10.10.0.2/32", "10.10.0.3/32", "10.10.0.4/32", "10.10.0.5/32", "10.10.0.2/32"} {
+		// every event brings a new object, so the same cidr is queued twice
+		claim := &extensions.IpClaim{
+			Metadata: metav1.ObjectMeta{Name: fmt.Sprintf("claim-%d", i)},
+			Spec:     extensions.IpClaimSpec{Cidr: cidr, NodeName: "second"},
+		}
+		c.claimStore.Add(claim)
+		queue.Add(claim)
+	}
+	for i := 0; i < c.AssignWorkers; i++ {
+		go c.worker()
+	}
+	utils.EventualCondition(t, time.Second*1, func() bool {
+		return handler.Calls() == 5
+	}, "Every queued claim should be processed")
+	handler.Lock()
+	defer handler.Unlock()
+	assert.True(t, handler.maxInflight > 1, "Claims should be processed in parallel")
+	assert.Equal(t, 0, handler.overlaps, "Claims of the same cidr should not be processed at once")
+}
+
+func TestReconcileLoop(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	fiphandler := &fakeIpHandler{}
+	c := claimController{
+		Uid:                 "first",
+		Iface:               "eth0",
+		ExtensionsClientset: ext,
+		iphandler:           fiphandler,
+		listRoutes:          noRoutes,
+		listAddrs: func() ([]netutils.LinkAddr, error) {
+			ip, network, _ := net.ParseCIDR("10.10.0.3/32")
+			network.IP = ip
+			return []netutils.LinkAddr{{Link: "eth0", Network: network}}, nil
+		},
+	}
+	claims := &extensions.IpClaimList{Items: []extensions.IpClaim{
+		{Spec: extensions.IpClaimSpec{Cidr: "10.10.0.2/32", NodeName: "first"}},
+		{Spec: extensions.IpClaimSpec{Cidr: "10.10.0.3/32", NodeName: "second"}},
+		{
+			Metadata: metav1.ObjectMeta{DeletionTimestamp: &metav1.Time{Time: time.Now()}},
+			Spec:     extensions.IpClaimSpec{Cidr: "10.10.0.4/32", NodeName: "first"},
+		},
+	}}
+	ext.Ipclaims.On("List", mock.Anything).Return(claims, nil)
+	fiphandler.On("Add", "eth0", "10.10.0.2/32").Return(nil)
+	fiphandler.On("Del", "eth0", "10.10.0.3/32").Return(nil)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	ticker := make(chan time.Time)
+	go c.reconcileLoop(stop, ticker)
+	ticker <- time.Time{}
+	utils.EventualCondition(t, time.Second*1, func() bool {
+		return assert.ObjectsAreEqual(2, len(fiphandler.Calls))
+	}, "Missing address should be added and foreign one removed", fiphandler.Calls)
+	fiphandler.AssertExpectations(t)
+}
+
+func TestAssignTimer(t *testing.T) {
+	now := time.Unix(100, 0)
+	timer := assignTimer{now: func() time.Time { return now }}
+	timer.start("10.10.0.2/32")
+	now = now.Add(time.Second)
+	timer.start("10.10.0.2/32")
+	timer.start("10.10.0.3/32")
+	now = now.Add(time.Second)
+
+	latency, exists := timer.stop("10.10.0.2/32")
+	assert.True(t, exists)
+	assert.Equal(t, 2*time.Second, latency, "Latency should be counted from the first observation")
+	_, exists = timer.stop("10.10.0.2/32")
+	assert.False(t, exists, "Assignment should be reported once")
+
+	timer.forget("10.10.0.3/32")
+	_, exists = timer.stop("10.10.0.3/32")
+	assert.False(t, exists)
+}
+
+func TestQuarantine(t *testing.T) {
+	q := quarantine{delay: time.Second, maxDelay: 5 * time.Second}
+	cidr := "10.10.0.2/32"
+	for i := 0; i < 2; i++ {
+		_, quarantined := q.failed(cidr, 3)
+		assert.False(t, quarantined, "CIDR should be retried right away before reaching max retries")
+	}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for _, delay := range expected {
+		actual, quarantined := q.failed(cidr, 3)
+		assert.True(t, quarantined)
+		assert.Equal(t, delay, actual)
+	}
+	q.succeeded(cidr)
+	_, quarantined := q.failed(cidr, 3)
+	assert.False(t, quarantined, "Successful assignment should reset failures")
+
+	for i := 0; i < 10; i++ {
+		_, quarantined = q.failed("10.10.0.3/32", 0)
+		assert.False(t, quarantined, "Quarantine should be disabled with 0 retries")
+	}
+}
+
+func TestWorkerQuarantine(t *testing.T) {
+	queue := workqueue.NewQueue()
+	defer queue.Close()
+	fiphandler := &fakeIpHandler{}
+	recorder := record.NewFakeRecorder(1)
+	c := claimController{
+		Uid:              "first",
+		Iface:            "eth0",
+		MaxAssignRetries: 3,
+		Recorder:         recorder,
+		claimStore:       cache.NewStore(cache.MetaNamespaceKeyFunc),
+		queue:            queue,
+		iphandler:        fiphandler,
+		quarantine:       quarantine{delay: time.Hour, maxDelay: time.Hour},
+	}
+	claim := &extensions.IpClaim{
+		Metadata: metav1.ObjectMeta{Name: "10-10-0-2-32"},
+		Spec:     extensions.IpClaimSpec{Cidr: "10.10.0.2/32", NodeName: "first"},
+	}
+	c.claimStore.Add(claim)
+	fiphandler.On("Add", "eth0", claim.Spec.Cidr).Return(fmt.Errorf("route conflict"))
+	go c.worker()
+	queue.Add(claim)
+	select {
+	case event := <-recorder.Events:
+		assert.Contains(t, event, ClaimQuarantinedReason)
+	case <-time.After(time.Second):
+		t.Fatalf("Quarantined claim should emit an event")
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, fiphandler.Calls, 3, "Quarantined claim should not be retried before backoff expires")
+}
+
+func TestWorkerQuarantineMovedClaim(t *testing.T) {
+	queue := workqueue.NewQueue()
+	defer queue.Close()
+	fiphandler := &fakeIpHandler{}
+	c := claimController{
+		Uid:              "first",
+		Iface:            "eth0",
+		MaxAssignRetries: 1,
+		claimStore:       cache.NewStore(cache.MetaNamespaceKeyFunc),
+		queue:            queue,
+		iphandler:        fiphandler,
+		quarantine:       quarantine{delay: 50 * time.Millisecond, maxDelay: time.Hour},
+	}
+	moved := &extensions.IpClaim{
+		Metadata: metav1.ObjectMeta{Name: "10-10-0-2-32", ResourceVersion: "1"},
+		Spec:     extensions.IpClaimSpec{Cidr: "10.10.0.2/32", NodeName: "first"},
+	}
+	stuck := &extensions.IpClaim{
+		Metadata: metav1.ObjectMeta{Name: "10-10-0-3-32", ResourceVersion: "1"},
+		Spec:     extensions.IpClaimSpec{Cidr: "10.10.0.3/32", NodeName: "first"},
+	}
+	c.claimStore.Add(moved)
+	c.claimStore.Add(stuck)
+	fiphandler.On("Add", "eth0", moved.Spec.Cidr).Return(fmt.Errorf("route conflict")).Once()
+	fiphandler.On("Add", "eth0", stuck.Spec.Cidr).Return(fmt.Errorf("route conflict"))
+	go c.worker()
+	queue.Add(moved)
+	queue.Add(stuck)
+	time.Sleep(20 * time.Millisecond)
+	// claim is moved to other node while it is quarantined
+	c.claimStore.Update(&extensions.IpClaim{
+		Metadata: metav1.ObjectMeta{Name: "10-10-0-2-32", ResourceVersion: "2"},
+		Spec:     extensions.IpClaimSpec{Cidr: "10.10.0.2/32", NodeName: "second"},
+	})
+	time.Sleep(200 * time.Millisecond)
+
+	added := map[string]int{}
+	for _, call := range fiphandler.Calls {
+		added[call.Arguments.String(1)]++
+	}
+	assert.Equal(t, 1, added[moved.Spec.Cidr], "Stale claim should not be retried after quarantine")
+	assert.True(t, added[stuck.Spec.Cidr] > 1, "Unchanged claim should be retried after quarantine")
+}
+
+func TestWorkerLinkMissing(t *testing.T) {
+	queue := workqueue.NewQueue()
+	defer queue.Close()
+	fiphandler := &fakeIpHandler{}
+	recorder := record.NewFakeRecorder(1)
+	c := claimController{
+		Uid:        "first",
+		Iface:      "eth0",
+		Recorder:   recorder,
+		claimStore: cache.NewStore(cache.MetaNamespaceKeyFunc),
+		queue:      queue,
+		iphandler:  fiphandler,
+	}
+	claim := &extensions.IpClaim{
+		Metadata: metav1.ObjectMeta{Name: "10-10-0-2-32", Finalizers: []string{extensions.IpClaimFinalizer}},
+		Spec:     extensions.IpClaimSpec{Cidr: "10.10.0.2/32", NodeName: "first"},
+		Status:   extensions.IpClaimStatus{NodeName: "first", State: extensions.IpClaimAssigned},
+	}
+	c.claimStore.Add(claim)
+	missing := &netutils.LinkMissingError{Link: "eth0", Err: fmt.Errorf("Link not found")}
+	fiphandler.On("Add", "eth0", claim.Spec.Cidr).Return(missing).Once()
+	fiphandler.On("Add", "eth0", claim.Spec.Cidr).Return(nil).Once()
+	go c.worker()
+	queue.Add(claim)
+	select {
+	case event := <-recorder.Events:
+		assert.Contains(t, event, LinkMissingReason)
+	case <-time.After(time.Second):
+		t.Fatalf("Claim with missing link should emit an event")
+	}
+	for i := 0; i < 100 && len(fiphandler.Calls) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	fiphandler.AssertExpectations(t)
+}
+
+func TestObserverMode(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	c := claimController{
+		Uid:                 "first",
+		Iface:               "eth0",
+		ExtensionsClientset: extensions.NewReadOnlyClientset(ext),
+		claimStore:          cache.NewStore(cache.MetaNamespaceKeyFunc),
+		iphandler:           netutils.DryRunIPHandler{},
+	}
+	claim := &extensions.IpClaim{
+		Metadata: metav1.ObjectMeta{Name: "10-10-0-2-32"},
+		Spec:     extensions.IpClaimSpec{Cidr: "10.10.0.2/32", NodeName: "first"},
+	}
+	c.claimStore.Add(claim)
+	ext.Ipclaims.On("Get", claim.Metadata.Name).Return(claim, nil)
+	assert.NoError(t, c.processClaim(claim))
+
+	qualResource := schema.GroupResource{Group: "ipcontroller", Resource: "ipnode"}
+	ext.Ipnodes.On("Get", c.Uid).Return(&extensions.IpNode{}, errors.NewNotFound(qualResource, c.Uid)).Once()
+	ext.Ipnodes.On("Get", c.Uid).Return(&extensions.IpNode{Metadata: metav1.ObjectMeta{Name: c.Uid}}, nil).Once()
+	ticker := make(chan time.Time, 2)
+	ticker <- time.Time{}
+	ticker <- time.Time{}
+	stop := make(chan struct{})
+	go c.heartbeatIpNode(stop, ticker)
+	utils.EventualCondition(t, time.Second*1, func() bool {
+		return assert.ObjectsAreEqual(2, len(ext.Ipnodes.Calls))
+	}, "Node should be fetched on every heartbeat", ext.Ipnodes.Calls)
+	close(stop)
+
+	for _, call := range append(ext.Ipclaims.Calls, ext.Ipnodes.Calls...) {
+		assert.Equal(t, "Get", call.Method, "Observer should not write objects")
+	}
+}
+
+func TestStartupJitter(t *testing.T) {
+	jitter := 200 * time.Millisecond
+	delays := map[time.Duration]bool{}
+	for _, uid := range []string{"first", "second", "third", "fourth"} {
+		delay := startupDelay(uid, jitter)
+		assert.True(t, delay >= 0 && delay < jitter, "Delay %v is out of bounds", delay)
+		assert.Equal(t, delay, startupDelay(uid, jitter), "Delay should be the same for a node")
+		delays[delay] = true
+	}
+	assert.True(t, len(delays) > 1, "Nodes should start at different times")
+
+	c := claimController{Uid: "first", StartupJitter: jitter}
+	stop := make(chan struct{})
+	start := time.Now()
+	assert.True(t, c.waitStartupJitter(stop))
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= startupDelay(c.Uid, jitter), "Start should be delayed, waited %v", elapsed)
+	assert.True(t, elapsed < jitter+100*time.Millisecond, "Start was delayed for too long: %v", elapsed)
+
+	close(stop)
+	c.StartupJitter = time.Hour
+	assert.False(t, c.waitStartupJitter(stop), "Waiting should be interrupted by stop")
+}
+
+func TestClaimLink(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	fiphandler := &fakeIpHandler{}
+	_, subnet, _ := net.ParseCIDR("10.10.0.0/24")
+	links := map[string]bool{"eth0": true, "eth1": true}
+	c := claimController{
+		Uid:                 "first",
+		Iface:               "eth0",
+		ExtensionsClientset: ext,
+		claimStore:          cache.NewStore(cache.MetaNamespaceKeyFunc),
+		// subnet matching selects eth0 for all claims
+		iphandler: netutils.AutoIfaceIPHandler{
+			Handler: fiphandler,
+			ListAddrs: func() ([]netutils.LinkAddr, error) {
+				return []netutils.LinkAddr{{Link: "eth0", Network: subnet}}, nil
+			},
+		},
+		LinkIPHandler: fiphandler,
+		checkLink: func(name string) error {
+			if !links[name] {
+				return fmt.Errorf("Link not found")
+			}
+			return nil
+		},
+	}
+	ext.Ipclaims.On("Get", mock.Anything).Return(&extensions.IpClaim{}, nil)
+	ext.Ipclaims.On("Update", mock.Anything).Return(nil)
+	fiphandler.On("Add", mock.Anything, mock.Anything).Return(nil)
+	fiphandler.On("Del", mock.Anything, mock.Anything).Return(nil)
+
+	claim := &extensions.IpClaim{
+		Metadata: metav1.ObjectMeta{Name: "10-10-0-2-32"},
+		Spec:     extensions.IpClaimSpec{Cidr: "10.10.0.2/32", NodeName: "first", Link: "eth1"},
+	}
+	c.claimStore.Add(claim)
+	assert.NoError(t, c.processClaim(claim))
+	fiphandler.AssertCalled(t, "Add", "eth1", "10.10.0.2/32")
+	fiphandler.AssertNotCalled(t, "Add", "eth0", "10.10.0.2/32")
+
+	c.claimStore.Delete(claim)
+	assert.NoError(t, c.processClaim(claim))
+	fiphandler.AssertCalled(t, "Del", "eth1", "10.10.0.2/32")
+
+	plain := &extensions.IpClaim{
+		Metadata: metav1.ObjectMeta{Name: "10-10-0-3-32"},
+		Spec:     extensions.IpClaimSpec{Cidr: "10.10.0.3/32", NodeName: "first"},
+	}
+	c.claimStore.Add(plain)
+	assert.NoError(t, c.processClaim(plain))
+	fiphandler.AssertCalled(t, "Add", "eth0", "10.10.0.3/32")
+
+	missing := &extensions.IpClaim{
+		Metadata: metav1.ObjectMeta{Name: "10-10-0-4-32"},
+		Spec:     extensions.IpClaimSpec{Cidr: "10.10.0.4/32", NodeName: "first", Link: "eth2"},
+	}
+	c.claimStore.Add(missing)
+	assert.Error(t, c.processClaim(missing), "Claim should not be assigned to a missing link")
+	fiphandler.AssertNotCalled(t, "Add", mock.Anything, "10.10.0.4/32")
+}
+
+func TestClaimFinalizer(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	fiphandler := &fakeIpHandler{}
+	c := claimController{
+		Uid:                 "first",
+		Iface:               "eth0",
+		ExtensionsClientset: ext,
+		claimStore:          cache.NewStore(cache.MetaNamespaceKeyFunc),
+		iphandler:           fiphandler,
+	}
+	claim := &extensions.IpClaim{
+		Metadata: metav1.ObjectMeta{Name: "10-10-0-2-32"},
+		Spec:     extensions.IpClaimSpec{Cidr: "10.10.0.2/32", NodeName: "first"},
+	}
+	c.claimStore.Add(claim)
+	fiphandler.On("Add", "eth0", claim.Spec.Cidr).Return(nil)
+	ext.Ipclaims.On("Get", claim.Metadata.Name).Return(&extensions.IpClaim{Metadata: claim.Metadata, Spec: claim.Spec}, nil).Once()
+	ext.Ipclaims.On("Update", mock.Anything).Return(nil).Once()
+	c.observe(claim)
+	assert.NoError(t, c.processClaim(claim))
+	_, exists := c.timer.stop(claim.Spec.Cidr)
+	assert.False(t, exists, "Assignment latency should be reported")
+	if !assert.Len(t, ext.Ipclaims.Calls, 2, "Assigned claim should be updated") {
+		return
+	}
+	updated := ext.Ipclaims.Calls[1].Arguments[0].(*extensions.IpClaim)
+	assert.Equal(t, []string{extensions.IpClaimFinalizer}, updated.Metadata.Finalizers,
+		"Finalizer should be added to assigned claim")
+	assert.Equal(t, "first", updated.Status.NodeName, "Status should show node that owns IP")
+	assert.Equal(t, extensions.IpClaimAssigned, updated.Status.State)
+	assert.False(t, updated.Status.AssignedAt.IsZero())
+
+	assert.NoError(t, c.processClaim(updated))
+	assert.Len(t, ext.Ipclaims.Calls, 2, "Claim that is marked as assigned should not be updated again")
+
+	deleting := &extensions.IpClaim{
+		Metadata: metav1.ObjectMeta{
+			Name:              claim.Metadata.Name,
+			DeletionTimestamp: &metav1.Time{Time: time.Now()},
+			Finalizers:        []string{extensions.IpClaimFinalizer},
+		},
+		Spec: claim.Spec,
+	}
+	c.claimStore.Update(deleting)
+	fiphandler.On("Del", "eth0", claim.Spec.Cidr).Return(fmt.Errorf("link is busy")).Once()
+	assert.Error(t, c.processClaim(deleting))
+	assert.Len(t, ext.Ipclaims.Calls, 2, "Finalizer should stay until IP is removed")
+
+	fiphandler.On("Del", "eth0", claim.Spec.Cidr).Return(nil).Once()
+	ext.Ipclaims.On("Get", claim.Metadata.Name).Return(deleting, nil).Once()
+	ext.Ipclaims.On("Update", mock.Anything).Return(nil).Once()
+	assert.NoError(t, c.processClaim(deleting))
+	updated = ext.Ipclaims.Calls[3].Arguments[0].(*extensions.IpClaim)
+	assert.Empty(t, updated.Metadata.Finalizers, "Finalizer should be removed after IP is removed")
+	fiphandler.AssertExpectations(t)
+}
+
+func assignCount(kind string) uint64 {
+	m := &dto.Metric{}
+	metrics.AssignLatency.WithLabelValues(kind).Write(m)
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestObserveReclaim(t *testing.T) {
+	c := claimController{Uid: "first"}
+	claim := &extensions.IpClaim{
+		Metadata: metav1.ObjectMeta{Name: "10-10-0-2-32"},
+		Spec:     extensions.IpClaimSpec{Cidr: "10.10.0.2/32", NodeName: "second"},
+		Status:   extensions.IpClaimStatus{NodeName: "second", State: extensions.IpClaimAssigned},
+	}
+	// failover, scheduler moves claim to this node
+	claim.ResetStatus()
+	claim.Spec.NodeName = "first"
+	initial, reclaim := assignCount(metrics.AssignInitial), assignCount(metrics.AssignReclaim)
+	c.observe(claim)
+	c.observeAssigned(claim)
+	assert.Equal(t, reclaim+1, assignCount(metrics.AssignReclaim), "Failover should be counted as reclaim")
+	assert.Equal(t, initial, assignCount(metrics.AssignInitial))
+
+	fresh := &extensions.IpClaim{
+		Metadata: metav1.ObjectMeta{Name: "10-10-0-3-32"},
+		Spec:     extensions.IpClaimSpec{Cidr: "10.10.0.3/32", NodeName: "first"},
+	}
+	fresh.ResetStatus()
+	c.observe(fresh)
+	c.observeAssigned(fresh)
+	assert.Equal(t, initial+1, assignCount(metrics.AssignInitial), "New claim should be counted as initial")
+}
+
+func TestMarkAssignedRescheduledClaim(t *testing.T) {
+	c := claimController{Uid: "first"}
+	claim := &extensions.IpClaim{
+		Metadata: metav1.ObjectMeta{Name: "10-10-0-2-32"},
+		Spec:     extensions.IpClaimSpec{Cidr: "10.10.0.2/32", NodeName: "second"},
+	}
+	assert.False(t, c.markAssigned(claim), "Claim scheduled on another node should not be marked")
+	assert.Empty(t, claim.Metadata.Finalizers)
+	assert.Empty(t, claim.Status.NodeName)
+
+	claim.Spec.NodeName = "first"
+	assert.True(t, c.markAssigned(claim))
+	assert.Equal(t, "first", claim.Status.NodeName)
+}
@@ -0,0 +1,52 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package claimcontroller
+
+import "sync"
+
+// inflight tracks cidrs that are being processed by workers, so claims of
+// the same cidr are never processed concurrently. Zero value is ready to use
+type inflight struct {
+	sync.Mutex
+	// latest item received for a cidr while it was processed, nil if none
+	pending map[string]interface{}
+}
+
+// start marks cidr as processed and returns true, if cidr is already
+// processed by another worker item is kept to be requeued later and false
+// is returned
+func (f *inflight) start(cidr string, item interface{}) bool {
+	f.Lock()
+	defer f.Unlock()
+	if f.pending == nil {
+		f.pending = map[string]interface{}{}
+	}
+	if _, exists := f.pending[cidr]; exists {
+		f.pending[cidr] = item
+		return false
+	}
+	f.pending[cidr] = nil
+	return true
+}
+
+// finish releases cidr and returns an item that was received for it while
+// it was processed, or nil
+func (f *inflight) finish(cidr string) interface{} {
+	f.Lock()
+	defer f.Unlock()
+	item := f.pending[cidr]
+	delete(f.pending, cidr)
+	return item
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package claimcontroller
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultQuarantineDelay    = 5 * time.Second
+	defaultMaxQuarantineDelay = 5 * time.Minute
+)
+
+// quarantine counts consecutive assignment failures of every cidr, cidrs
+// that failed maxRetries times are retried with exponential backoff instead
+// of being requeued right away. Zero value is ready to use
+type quarantine struct {
+	sync.Mutex
+	failures map[string]int
+	// overridden in tests
+	delay    time.Duration
+	maxDelay time.Duration
+}
+
+// failed records a failure of cidr and returns a delay before the next
+// attempt, false is returned if cidr is not quarantined yet.
+// Quarantine is disabled if maxRetries is 0
+func (q *quarantine) failed(cidr string, maxRetries int) (time.Duration, bool) {
+	q.Lock()
+	defer q.Unlock()
+	if maxRetries <= 0 {
+		return 0, false
+	}
+	if q.failures == nil {
+		q.failures = map[string]int{}
+	}
+	q.failures[cidr]++
+	excess := q.failures[cidr] - maxRetries
+	if excess < 0 {
+		return 0, false
+	}
+	delay, maxDelay := q.delay, q.maxDelay
+	if delay == 0 {
+		delay = defaultQuarantineDelay
+	}
+	if maxDelay == 0 {
+		maxDelay = defaultMaxQuarantineDelay
+	}
+	for i := 0; i < excess && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay, true
+}
+
+// succeeded resets failure counter of cidr
+func (q *quarantine) succeeded(cidr string) {
+	q.Lock()
+	defer q.Unlock()
+	delete(q.failures, cidr)
+}
@@ -0,0 +1,66 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package claimcontroller
+
+import (
+	"sync"
+	"time"
+)
+
+// assignTimer correlates the moment a claim is observed with the moment its
+// IP is assigned, entries are keyed by cidr. Zero value is ready to use
+type assignTimer struct {
+	sync.Mutex
+	started map[string]time.Time
+	// overridden in tests
+	now func() time.Time
+}
+
+func (t *assignTimer) currentTime() time.Time {
+	if t.now != nil {
+		return t.now()
+	}
+	return time.Now()
+}
+
+// start records observation time of cidr unless it is already recorded
+func (t *assignTimer) start(cidr string) {
+	t.Lock()
+	defer t.Unlock()
+	if t.started == nil {
+		t.started = map[string]time.Time{}
+	}
+	if _, exists := t.started[cidr]; !exists {
+		t.started[cidr] = t.currentTime()
+	}
+}
+
+// stop returns time passed since cidr was observed and forgets it
+func (t *assignTimer) stop(cidr string) (time.Duration, bool) {
+	t.Lock()
+	defer t.Unlock()
+	started, exists := t.started[cidr]
+	if !exists {
+		return 0, false
+	}
+	delete(t.started, cidr)
+	return t.currentTime().Sub(started), true
+}
+
+func (t *assignTimer) forget(cidr string) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.started, cidr)
+}
@@ -44,7 +44,7 @@ type ExternalIpController struct {
 	resyncInterval time.Duration
 }
 
-func NewExternalIpController(config *rest.Config, uid, iface, mask string, resyncInterval time.Duration) (*ExternalIpController, error) {
+func NewExternalIpController(config *rest.Config, uid, iface, mask string, resyncInterval time.Duration, ipHandler netutils.IPHandler) (*ExternalIpController, error) {
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		return nil, err
@@ -63,7 +63,7 @@ func NewExternalIpController(config *rest.Config, uid, iface, mask string, resyn
 		Iface:          iface,
 		Mask:           mask,
 		source:         lw,
-		ipHandler:      netutils.LinuxIPHandler{},
+		ipHandler:      ipHandler,
 		Queue:          workqueue.NewQueue(),
 		resyncInterval: resyncInterval,
 	}, nil
@@ -75,7 +75,7 @@ func NewExternalIpControllerWithSource(uid, iface, mask string, source cache.Lis
 		Iface:     iface,
 		Mask:      mask,
 		source:    source,
-		ipHandler: netutils.LinuxIPHandler{},
+		ipHandler: netutils.LinuxIPHandler{GARPCount: netutils.DefaultGARPCount},
 		Queue:     workqueue.NewQueue(),
 	}
 }
@@ -196,11 +196,22 @@ func (c *ExternalIpController) processServiceExternalIPs(old, cur *v1.Service, s
 	neglectIPsInUse(ips_to_remove, key, store)
 
 	for ip := range ips_to_add {
-		cidr := ip + "/" + c.Mask
-		c.Queue.Add(&netutils.AddCIDR{cidr})
+		if cidr, err := c.cidr(ip); err == nil {
+			c.Queue.Add(&netutils.AddCIDR{cidr})
+		}
 	}
 	for ip := range ips_to_remove {
-		cidr := ip + "/" + c.Mask
-		c.Queue.Add(&netutils.DelCIDR{cidr})
+		if cidr, err := c.cidr(ip); err == nil {
+			c.Queue.Add(&netutils.DelCIDR{cidr})
+		}
+	}
+}
+
+func (c *ExternalIpController) cidr(ip string) (string, error) {
+	addr, mask, err := netutils.ParseExternalIP(ip, c.Mask)
+	if err != nil {
+		glog.Errorf("Skipping external IP %v: %v", ip, err)
+		return "", err
 	}
+	return addr + "/" + mask, nil
 }
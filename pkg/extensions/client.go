@@ -21,7 +21,6 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
@@ -43,11 +42,9 @@ func WrapClientsetWithExtensions(clientset *kubernetes.Clientset, config *rest.C
 
 func extensionClient(config *rest.Config) (*rest.RESTClient, error) {
 	config.APIPath = "/apis"
+	groupVersion := SchemeGroupVersion
 	config.ContentConfig = rest.ContentConfig{
-		GroupVersion: &schema.GroupVersion{
-			Group:   GroupName,
-			Version: Version,
-		},
+		GroupVersion:         &groupVersion,
 		NegotiatedSerializer: serializer.DirectCodecFactory{CodecFactory: api.Codecs},
 		ContentType:          runtime.ContentTypeJSON,
 	}
@@ -86,6 +83,7 @@ type IPClaimPoolsInterface interface {
 	Create(*IpClaimPool) (*IpClaimPool, error)
 	Get(name string) (*IpClaimPool, error)
 	List(metav1.ListOptions) (*IpClaimPoolList, error)
+	Watch(metav1.ListOptions) (watch.Interface, error)
 	Update(*IpClaimPool) (*IpClaimPool, error)
 	Delete(string, *metav1.DeleteOptions) error
 }
@@ -122,7 +120,7 @@ func (c *IPNodesClient) Create(ipnode *IpNode) (result *IpNode, err error) {
 	result = &IpNode{}
 	resp, err := c.client.Post().
 		Namespace("default").
-		Resource("ipnodes").
+		Resource(IpNodeResource.Plural).
 		Body(ipnode).
 		DoRaw()
 	if err != nil {
@@ -139,7 +137,7 @@ func (c *IPNodesClient) List(opts metav1.ListOptions) (result *IpNodeList, err e
 	}
 	resp, err := c.client.Get().
 		Namespace("default").
-		Resource("ipnodes").
+		Resource(IpNodeResource.Plural).
 		LabelsSelectorParam(selector).
 		DoRaw()
 	if err != nil {
@@ -152,7 +150,7 @@ func (c *IPNodesClient) Watch(opts metav1.ListOptions) (watch.Interface, error)
 	return c.client.Get().
 		Namespace("default").
 		Prefix("watch").
-		Resource("ipnodes").
+		Resource(IpNodeResource.Plural).
 		VersionedParams(&opts, api.ParameterCodec).
 		Watch()
 }
@@ -161,7 +159,7 @@ func (c *IPNodesClient) Update(ipnode *IpNode) (result *IpNode, err error) {
 	result = &IpNode{}
 	resp, err := c.client.Put().
 		Namespace("default").
-		Resource("ipnodes").
+		Resource(IpNodeResource.Plural).
 		Name(ipnode.Metadata.Name).
 		Body(ipnode).
 		DoRaw()
@@ -174,7 +172,7 @@ func (c *IPNodesClient) Update(ipnode *IpNode) (result *IpNode, err error) {
 func (c *IPNodesClient) Delete(name string, options *metav1.DeleteOptions) error {
 	return c.client.Delete().
 		Namespace("default").
-		Resource("ipnodes").
+		Resource(IpNodeResource.Plural).
 		Name(name).
 		Body(options).
 		Do().
@@ -185,7 +183,7 @@ func (c *IPNodesClient) Get(name string) (result *IpNode, err error) {
 	result = &IpNode{}
 	resp, err := c.client.Get().
 		Namespace("default").
-		Resource("ipnodes").
+		Resource(IpNodeResource.Plural).
 		Name(name).
 		DoRaw()
 	if err != nil {
@@ -197,8 +195,8 @@ func (c *IPNodesClient) Get(name string) (result *IpNode, err error) {
 func (c *IpClaimClient) Get(name string) (result *IpClaim, err error) {
 	result = &IpClaim{}
 	err = c.client.Get().
-		Namespace("default").
-		Resource("ipclaims").
+		Namespace(claimsNamespace).
+		Resource(IpClaimResource.Plural).
 		Name(name).
 		Do().
 		Into(result)
@@ -209,8 +207,8 @@ func (c *IpClaimClient) Get(name string) (result *IpClaim, err error) {
 func (c *IpClaimClient) Create(ipclaim *IpClaim) (result *IpClaim, err error) {
 	result = &IpClaim{}
 	resp, err := c.client.Post().
-		Namespace("default").
-		Resource("ipclaims").
+		Namespace(claimsNamespace).
+		Resource(IpClaimResource.Plural).
 		Body(ipclaim).
 		DoRaw()
 	if err != nil {
@@ -226,8 +224,8 @@ func (c *IpClaimClient) List(opts metav1.ListOptions) (result *IpClaimList, err
 		return nil, err
 	}
 	resp, err := c.client.Get().
-		Namespace("default").
-		Resource("ipclaims").
+		Namespace(claimsNamespace).
+		Resource(IpClaimResource.Plural).
 		LabelsSelectorParam(selector).
 		DoRaw()
 	if err != nil {
@@ -238,9 +236,9 @@ func (c *IpClaimClient) List(opts metav1.ListOptions) (result *IpClaimList, err
 
 func (c *IpClaimClient) Watch(opts metav1.ListOptions) (watch.Interface, error) {
 	return c.client.Get().
-		Namespace("default").
+		Namespace(claimsNamespace).
 		Prefix("watch").
-		Resource("ipclaims").
+		Resource(IpClaimResource.Plural).
 		Param("resourceVersion", opts.ResourceVersion).
 		Watch()
 }
@@ -248,8 +246,8 @@ func (c *IpClaimClient) Watch(opts metav1.ListOptions) (watch.Interface, error)
 func (c *IpClaimClient) Update(ipclaim *IpClaim) (result *IpClaim, err error) {
 	result = &IpClaim{}
 	resp, err := c.client.Put().
-		Namespace("default").
-		Resource("ipclaims").
+		Namespace(claimsNamespace).
+		Resource(IpClaimResource.Plural).
 		Name(ipclaim.Metadata.Name).
 		Body(ipclaim).
 		DoRaw()
@@ -261,8 +259,8 @@ func (c *IpClaimClient) Update(ipclaim *IpClaim) (result *IpClaim, err error) {
 
 func (c *IpClaimClient) Delete(name string, options *metav1.DeleteOptions) error {
 	return c.client.Delete().
-		Namespace("default").
-		Resource("ipclaims").
+		Namespace(claimsNamespace).
+		Resource(IpClaimResource.Plural).
 		Name(name).
 		Body(options).
 		Do().
@@ -272,8 +270,8 @@ func (c *IpClaimClient) Delete(name string, options *metav1.DeleteOptions) error
 func (c *IpClaimPoolClient) Get(name string) (result *IpClaimPool, err error) {
 	result = &IpClaimPool{}
 	err = c.client.Get().
-		Namespace("default").
-		Resource("ipclaimpools").
+		Namespace(claimsNamespace).
+		Resource(IpClaimPoolResource.Plural).
 		Name(name).
 		Do().
 		Into(result)
@@ -284,8 +282,8 @@ func (c *IpClaimPoolClient) Get(name string) (result *IpClaimPool, err error) {
 func (c *IpClaimPoolClient) Create(ipclaimpool *IpClaimPool) (result *IpClaimPool, err error) {
 	result = &IpClaimPool{}
 	resp, err := c.client.Post().
-		Namespace("default").
-		Resource("ipclaimpools").
+		Namespace(claimsNamespace).
+		Resource(IpClaimPoolResource.Plural).
 		Body(ipclaimpool).
 		DoRaw()
 	if err != nil {
@@ -297,8 +295,8 @@ func (c *IpClaimPoolClient) Create(ipclaimpool *IpClaimPool) (result *IpClaimPoo
 func (c *IpClaimPoolClient) List(opts metav1.ListOptions) (result *IpClaimPoolList, err error) {
 	result = &IpClaimPoolList{}
 	resp, err := c.client.Get().
-		Namespace("default").
-		Resource("ipclaimpools").
+		Namespace(claimsNamespace).
+		Resource(IpClaimPoolResource.Plural).
 		VersionedParams(&opts, api.ParameterCodec).
 		DoRaw()
 	if err != nil {
@@ -307,10 +305,19 @@ func (c *IpClaimPoolClient) List(opts metav1.ListOptions) (result *IpClaimPoolLi
 	return result, decodeResponseInto(resp, result)
 }
 
+func (c *IpClaimPoolClient) Watch(opts metav1.ListOptions) (watch.Interface, error) {
+	return c.client.Get().
+		Namespace(claimsNamespace).
+		Prefix("watch").
+		Resource(IpClaimPoolResource.Plural).
+		Param("resourceVersion", opts.ResourceVersion).
+		Watch()
+}
+
 func (c *IpClaimPoolClient) Delete(name string, options *metav1.DeleteOptions) error {
 	return c.client.Delete().
-		Namespace("default").
-		Resource("ipclaimpools").
+		Namespace(claimsNamespace).
+		Resource(IpClaimPoolResource.Plural).
 		Name(name).
 		Body(options).
 		Do().
@@ -320,8 +327,8 @@ func (c *IpClaimPoolClient) Delete(name string, options *metav1.DeleteOptions) e
 func (c *IpClaimPoolClient) Update(ipclaimpool *IpClaimPool) (result *IpClaimPool, err error) {
 	result = &IpClaimPool{}
 	resp, err := c.client.Put().
-		Namespace("default").
-		Resource("ipclaimpools").
+		Namespace(claimsNamespace).
+		Resource(IpClaimPoolResource.Plural).
 		Name(ipclaimpool.Metadata.Name).
 		Body(ipclaimpool).
 		DoRaw()
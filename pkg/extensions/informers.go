@@ -0,0 +1,298 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extensions
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+)
+
+// NewListWatch returns list and watch functions for a given resource
+func NewListWatch(client ExtensionsClientset, res *ResourceDefinition) cache.ListerWatcher {
+	switch res {
+	case &IpNodeResource:
+		return &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return client.IPNodes().List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return client.IPNodes().Watch(options)
+			},
+		}
+	case &IpClaimPoolResource:
+		return &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return client.IPClaimPools().List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return client.IPClaimPools().Watch(options)
+			},
+		}
+	case &IpClaimResource:
+		return &cache.ListWatch{
+			ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+				return client.IPClaims().List(options)
+			},
+			WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+				return client.IPClaims().Watch(options)
+			},
+		}
+	}
+	panic(fmt.Sprintf("List and watch of resource %s is not supported", res.Name))
+}
+
+// InformerFactory creates shared informers of custom resources, every
+// resource has a single informer shared by all consumers
+type InformerFactory struct {
+	resync time.Duration
+	// newListWatch is overridden in tests
+	newListWatch func(*ResourceDefinition) cache.ListerWatcher
+
+	lock      sync.Mutex
+	informers map[string]cache.SharedIndexInformer
+	started   map[string]bool
+}
+
+func NewInformerFactory(client ExtensionsClientset, resync time.Duration) *InformerFactory {
+	return &InformerFactory{
+		resync: resync,
+		newListWatch: func(res *ResourceDefinition) cache.ListerWatcher {
+			return NewListWatch(client, res)
+		},
+		informers: map[string]cache.SharedIndexInformer{},
+		started:   map[string]bool{},
+	}
+}
+
+func (f *InformerFactory) informerFor(res *ResourceDefinition, obj runtime.Object) cache.SharedIndexInformer {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if informer, exists := f.informers[res.Name]; exists {
+		return informer
+	}
+	informer := cache.NewSharedIndexInformer(f.newListWatch(res), obj, f.resync, cache.Indexers{})
+	f.informers[res.Name] = informer
+	return informer
+}
+
+func (f *InformerFactory) IpNodes() IpNodeInformer {
+	return IpNodeInformer{f.informerFor(&IpNodeResource, &IpNode{})}
+}
+
+func (f *InformerFactory) IpClaims() IpClaimInformer {
+	return IpClaimInformer{f.informerFor(&IpClaimResource, &IpClaim{})}
+}
+
+func (f *InformerFactory) IpClaimPools() IpClaimPoolInformer {
+	return IpClaimPoolInformer{f.informerFor(&IpClaimPoolResource, &IpClaimPool{})}
+}
+
+// Start runs informers that were requested and not started yet
+func (f *InformerFactory) Start(stop <-chan struct{}) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for name, informer := range f.informers {
+		if !f.started[name] {
+			go informer.Run(stop)
+			f.started[name] = true
+		}
+	}
+}
+
+// WaitForCacheSync waits until all started informers are synced, false is
+// returned if stop was closed before
+func (f *InformerFactory) WaitForCacheSync(stop <-chan struct{}) bool {
+	f.lock.Lock()
+	synced := []cache.InformerSynced{}
+	for name, informer := range f.informers {
+		if f.started[name] {
+			synced = append(synced, informer.HasSynced)
+		}
+	}
+	f.lock.Unlock()
+	return cache.WaitForCacheSync(stop, synced...)
+}
+
+type IpNodeInformer struct {
+	informer cache.SharedIndexInformer
+}
+
+func (i IpNodeInformer) Informer() cache.SharedIndexInformer {
+	return i.informer
+}
+
+func (i IpNodeInformer) Lister() IpNodeLister {
+	return IpNodeLister{i.informer.GetIndexer()}
+}
+
+type IpClaimInformer struct {
+	informer cache.SharedIndexInformer
+}
+
+func (i IpClaimInformer) Informer() cache.SharedIndexInformer {
+	return i.informer
+}
+
+func (i IpClaimInformer) Lister() IpClaimLister {
+	return IpClaimLister{i.informer.GetIndexer()}
+}
+
+// AddEventHandler adds handler of IP claim changes, e.g. changes of nodes
+// that own IPs
+func (i IpClaimInformer) AddEventHandler(handler IpClaimEventHandlerFuncs) {
+	i.informer.AddEventHandler(handler)
+}
+
+type IpClaimPoolInformer struct {
+	informer cache.SharedIndexInformer
+}
+
+func (i IpClaimPoolInformer) Informer() cache.SharedIndexInformer {
+	return i.informer
+}
+
+func (i IpClaimPoolInformer) Lister() IpClaimPoolLister {
+	return IpClaimPoolLister{i.informer.GetIndexer()}
+}
+
+// IpClaimEventHandlerFuncs receives typed claims, nil functions are skipped.
+// Claims deleted while watch was down are passed to DeleteFunc with their
+// last known state
+type IpClaimEventHandlerFuncs struct {
+	AddFunc    func(claim *IpClaim)
+	UpdateFunc func(old, cur *IpClaim)
+	DeleteFunc func(claim *IpClaim)
+}
+
+func (h IpClaimEventHandlerFuncs) OnAdd(obj interface{}) {
+	if claim, ok := obj.(*IpClaim); ok && h.AddFunc != nil {
+		h.AddFunc(claim)
+	}
+}
+
+func (h IpClaimEventHandlerFuncs) OnUpdate(oldObj, newObj interface{}) {
+	old, oldOk := oldObj.(*IpClaim)
+	cur, curOk := newObj.(*IpClaim)
+	if oldOk && curOk && h.UpdateFunc != nil {
+		h.UpdateFunc(old, cur)
+	}
+}
+
+func (h IpClaimEventHandlerFuncs) OnDelete(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if claim, ok := obj.(*IpClaim); ok && h.DeleteFunc != nil {
+		h.DeleteFunc(claim)
+	}
+}
+
+// resourceKey returns cache key of a resource object with a given name
+func resourceKey(res *ResourceDefinition, name string) string {
+	if res.Scope == apiextensionsv1beta1.NamespaceScoped {
+		return claimsNamespace + "/" + name
+	}
+	return name
+}
+
+// getByName returns object of a resource from indexer or NotFound error
+func getByName(indexer cache.Indexer, res *ResourceDefinition, name string) (interface{}, error) {
+	obj, exists, err := indexer.GetByKey(resourceKey(res, name))
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.NewNotFound(res.GroupVersionResource().GroupResource(), name)
+	}
+	return obj, nil
+}
+
+type IpNodeLister struct {
+	indexer cache.Indexer
+}
+
+func (l IpNodeLister) List(selector labels.Selector) []*IpNode {
+	result := []*IpNode{}
+	for _, obj := range l.indexer.List() {
+		node := obj.(*IpNode)
+		if selector.Matches(labels.Set(node.Metadata.Labels)) {
+			result = append(result, node)
+		}
+	}
+	return result
+}
+
+func (l IpNodeLister) Get(name string) (*IpNode, error) {
+	obj, err := getByName(l.indexer, &IpNodeResource, name)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*IpNode), nil
+}
+
+type IpClaimLister struct {
+	indexer cache.Indexer
+}
+
+func (l IpClaimLister) List(selector labels.Selector) []*IpClaim {
+	result := []*IpClaim{}
+	for _, obj := range l.indexer.List() {
+		claim := obj.(*IpClaim)
+		if selector.Matches(labels.Set(claim.Metadata.Labels)) {
+			result = append(result, claim)
+		}
+	}
+	return result
+}
+
+func (l IpClaimLister) Get(name string) (*IpClaim, error) {
+	obj, err := getByName(l.indexer, &IpClaimResource, name)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*IpClaim), nil
+}
+
+type IpClaimPoolLister struct {
+	indexer cache.Indexer
+}
+
+func (l IpClaimPoolLister) List(selector labels.Selector) []*IpClaimPool {
+	result := []*IpClaimPool{}
+	for _, obj := range l.indexer.List() {
+		pool := obj.(*IpClaimPool)
+		if selector.Matches(labels.Set(pool.Metadata.Labels)) {
+			result = append(result, pool)
+		}
+	}
+	return result
+}
+
+func (l IpClaimPoolLister) Get(name string) (*IpClaimPool, error) {
+	obj, err := getByName(l.indexer, &IpClaimPoolResource, name)
+	if err != nil {
+		return nil, err
+	}
+	return obj.(*IpClaimPool), nil
+}
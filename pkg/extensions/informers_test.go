@@ -0,0 +1,126 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extensions
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	fcache "k8s.io/client-go/tools/cache/testing"
+)
+
+func TestNewListWatch(t *testing.T) {
+	for _, res := range []*ResourceDefinition{&IpNodeResource, &IpClaimResource, &IpClaimPoolResource} {
+		if NewListWatch(nil, res) == nil {
+			t.Errorf("Missing list and watch of resource %s", res.Name)
+		}
+	}
+
+	unknown := IpClaimResource
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Unknown resource %s should not be listed as IP claims", unknown.Name)
+		}
+	}()
+	NewListWatch(nil, &unknown)
+}
+
+func TestIpClaimInformer(t *testing.T) {
+	source := fcache.NewFakeControllerSource()
+	factory := NewInformerFactory(nil, 0)
+	factory.newListWatch = func(res *ResourceDefinition) cache.ListerWatcher {
+		if res != &IpClaimResource {
+			t.Errorf("Unexpected resource %v", res.Name)
+		}
+		return source
+	}
+	if factory.IpClaims().Informer() != factory.IpClaims().Informer() {
+		t.Errorf("Informer of the same resource must be shared")
+	}
+
+	added := make(chan *IpClaim, 1)
+	updated := make(chan *IpClaim, 1)
+	deleted := make(chan *IpClaim, 1)
+	factory.IpClaims().AddEventHandler(IpClaimEventHandlerFuncs{
+		AddFunc:    func(claim *IpClaim) { added <- claim },
+		UpdateFunc: func(old, cur *IpClaim) { updated <- cur },
+		DeleteFunc: func(claim *IpClaim) { deleted <- claim },
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	if !factory.WaitForCacheSync(stop) {
+		t.Fatalf("Informers are not synced")
+	}
+
+	claim := &IpClaim{
+		Metadata: metav1.ObjectMeta{
+			Name:   "10-10-0-2-24",
+			Labels: map[string]string{"ipnode": "first"},
+		},
+		Spec: IpClaimSpec{Cidr: "10.10.0.2/24"},
+	}
+	lister := factory.IpClaims().Lister()
+	source.Add(claim)
+	select {
+	case received := <-added:
+		if received.Spec.Cidr != claim.Spec.Cidr {
+			t.Errorf("Unexpected claim added %v", received)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Add event was not delivered")
+	}
+	if _, err := lister.Get(claim.Metadata.Name); err != nil {
+		t.Errorf("Claim must be listed: %v", err)
+	}
+	selected := lister.List(labels.SelectorFromSet(labels.Set{"ipnode": "first"}))
+	if len(selected) != 1 {
+		t.Errorf("Expected 1 claim selected, got %v", selected)
+	}
+
+	changed := *claim
+	changed.Metadata.Labels = map[string]string{"ipnode": "second"}
+	changed.Spec.NodeName = "second"
+	source.Modify(&changed)
+	select {
+	case received := <-updated:
+		if received.Spec.NodeName != "second" {
+			t.Errorf("Unexpected claim update %v", received)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Update event was not delivered")
+	}
+	selected = lister.List(labels.SelectorFromSet(labels.Set{"ipnode": "first"}))
+	if len(selected) != 0 {
+		t.Errorf("Expected no claims selected, got %v", selected)
+	}
+
+	source.Delete(&changed)
+	select {
+	case received := <-deleted:
+		if received.Metadata.Name != claim.Metadata.Name {
+			t.Errorf("Unexpected claim deleted %v", received)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Delete event was not delivered")
+	}
+	if _, err := lister.Get(claim.Metadata.Name); !errors.IsNotFound(err) {
+		t.Errorf("Expected NotFound error, got %v", err)
+	}
+}
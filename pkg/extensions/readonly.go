@@ -0,0 +1,101 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extensions
+
+import (
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NewReadOnlyClientset returns clientset that reads objects with ext and
+// only logs creations, updates and removals, it is used in observer mode
+func NewReadOnlyClientset(ext ExtensionsClientset) ExtensionsClientset {
+	return &readOnlyClientset{ext}
+}
+
+type readOnlyClientset struct {
+	ext ExtensionsClientset
+}
+
+func (r *readOnlyClientset) IPNodes() IPNodesInterface {
+	return &readOnlyIPNodes{r.ext.IPNodes()}
+}
+
+func (r *readOnlyClientset) IPClaims() IPClaimsInterface {
+	return &readOnlyIPClaims{r.ext.IPClaims()}
+}
+
+func (r *readOnlyClientset) IPClaimPools() IPClaimPoolsInterface {
+	return &readOnlyIPClaimPools{r.ext.IPClaimPools()}
+}
+
+type readOnlyIPNodes struct {
+	IPNodesInterface
+}
+
+func (r *readOnlyIPNodes) Create(ipnode *IpNode) (*IpNode, error) {
+	glog.Infof("observer: action=create ipnode=%s", ipnode.Metadata.Name)
+	return ipnode, nil
+}
+
+func (r *readOnlyIPNodes) Update(ipnode *IpNode) (*IpNode, error) {
+	glog.V(3).Infof("observer: action=update ipnode=%s revision=%d", ipnode.Metadata.Name, ipnode.Revision)
+	return ipnode, nil
+}
+
+func (r *readOnlyIPNodes) Delete(name string, opts *metav1.DeleteOptions) error {
+	glog.Infof("observer: action=delete ipnode=%s", name)
+	return nil
+}
+
+type readOnlyIPClaims struct {
+	IPClaimsInterface
+}
+
+func (r *readOnlyIPClaims) Create(ipclaim *IpClaim) (*IpClaim, error) {
+	glog.Infof("observer: action=create ipclaim=%s cidr=%s node=%s",
+		ipclaim.Metadata.Name, ipclaim.Spec.Cidr, ipclaim.Spec.NodeName)
+	return ipclaim, nil
+}
+
+func (r *readOnlyIPClaims) Update(ipclaim *IpClaim) (*IpClaim, error) {
+	glog.Infof("observer: action=update ipclaim=%s cidr=%s node=%s state=%s",
+		ipclaim.Metadata.Name, ipclaim.Spec.Cidr, ipclaim.Spec.NodeName, ipclaim.Status.State)
+	return ipclaim, nil
+}
+
+func (r *readOnlyIPClaims) Delete(name string, opts *metav1.DeleteOptions) error {
+	glog.Infof("observer: action=delete ipclaim=%s", name)
+	return nil
+}
+
+type readOnlyIPClaimPools struct {
+	IPClaimPoolsInterface
+}
+
+func (r *readOnlyIPClaimPools) Create(pool *IpClaimPool) (*IpClaimPool, error) {
+	glog.Infof("observer: action=create ipclaimpool=%s cidr=%s", pool.Metadata.Name, pool.Spec.CIDR)
+	return pool, nil
+}
+
+func (r *readOnlyIPClaimPools) Update(pool *IpClaimPool) (*IpClaimPool, error) {
+	glog.Infof("observer: action=update ipclaimpool=%s cidr=%s", pool.Metadata.Name, pool.Spec.CIDR)
+	return pool, nil
+}
+
+func (r *readOnlyIPClaimPools) Delete(name string, opts *metav1.DeleteOptions) error {
+	glog.Infof("observer: action=delete ipclaimpool=%s", name)
+	return nil
+}
@@ -15,45 +15,137 @@
 package extensions
 
 import (
+	"context"
 	"fmt"
-
-	"time"
-
+	"net/http"
 	"strings"
+	"time"
 
+	"github.com/golang/glog"
 	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
 	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/pkg/api"
 	"k8s.io/client-go/rest"
 )
 
+// DefaultCRDCreateRetries is how many times creation of a CRD is retried
+const DefaultCRDCreateRetries = 5
+
+// ResourceDefinition describes names and scope of a custom resource
+type ResourceDefinition struct {
+	// Name selects resources managed by EnsureCRDsExistFiltered and
+	// RemoveCRDsFiltered
+	Name     string
+	Group    string
+	Version  string
+	Kind     string
+	Plural   string
+	Singular string
+	Scope    apiextensionsv1beta1.ResourceScope
+}
+
+// CRDName returns name of the custom resource definition
+func (r *ResourceDefinition) CRDName() string {
+	return fmt.Sprintf("%s.%s", r.Plural, r.Group)
+}
+
+// GroupVersionResource returns GVR of the resource, e.g. for dynamic clients
+func (r *ResourceDefinition) GroupVersionResource() schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: r.Group, Version: r.Version, Resource: r.Plural}
+}
+
 var (
-	resources = []string{"ip-node", "ip-claim", "ip-claim-pool"}
+	IpNodeResource = ResourceDefinition{
+		Name:     "ip-node",
+		Group:    GroupName,
+		Version:  Version,
+		Kind:     "IpNode",
+		Plural:   "ipnodes",
+		Singular: "ipnode",
+		Scope:    apiextensionsv1beta1.ClusterScoped,
+	}
+	IpClaimResource = ResourceDefinition{
+		Name:     "ip-claim",
+		Group:    GroupName,
+		Version:  Version,
+		Kind:     "IpClaim",
+		Plural:   "ipclaims",
+		Singular: "ipclaim",
+		Scope:    apiextensionsv1beta1.ClusterScoped,
+	}
+	IpClaimPoolResource = ResourceDefinition{
+		Name:     "ip-claim-pool",
+		Group:    GroupName,
+		Version:  Version,
+		Kind:     "IpClaimPool",
+		Plural:   "ipclaimpools",
+		Singular: "ipclaimpool",
+		Scope:    apiextensionsv1beta1.ClusterScoped,
+	}
+
+	// Resources are all custom resources used by controllers
+	Resources = []*ResourceDefinition{&IpNodeResource, &IpClaimResource, &IpClaimPoolResource}
+
+	crdCreateBackoff = wait.Backoff{
+		Duration: 500 * time.Millisecond,
+		Factor:   2,
+		Jitter:   0.1,
+	}
+	// claimsNamespace is used by clients of claims and pools
+	claimsNamespace = "default"
 )
 
-func fqName(name string) string {
-	return fmt.Sprintf("%s.%s", name, GroupName)
+// SetNamespacedClaims makes IpClaim and IpClaimPool resources namespace
+// scoped, claims and pools will be managed only in a given namespace.
+// IpNode resource stays cluster scoped. It has to be called before CRDs
+// are created, scope of an existing CRD is not changed
+func SetNamespacedClaims(namespace string) {
+	IpClaimResource.Scope = apiextensionsv1beta1.NamespaceScoped
+	IpClaimPoolResource.Scope = apiextensionsv1beta1.NamespaceScoped
+	claimsNamespace = namespace
+}
+
+// SetGroupVersion changes API group and version of all custom resources,
+// e.g. to run two incompatible versions of controllers side by side during
+// migration. It has to be called before clients are created and CRDs are
+// managed
+func SetGroupVersion(group, version string) {
+	for _, res := range Resources {
+		res.Group = group
+		res.Version = version
+	}
+	SchemeGroupVersion = schema.GroupVersion{Group: group, Version: version}
+	// types are decoded by api scheme, so they are registered for new
+	// group version as well
+	addKnownTypes(api.Scheme)
+}
+
+func EnsureCRDsExist(config *rest.Config) error {
+	return EnsureCRDsExistWithRetries(config, DefaultCRDCreateRetries)
 }
 
-func lowercase(name string) string {
-	parts := strings.Split(name, "-")
-	return strings.Join(parts, "")
+// EnsureCRDsExistWithRetries creates all CRDs, creation of every CRD is
+// retried with exponential backoff on transient api server errors
+func EnsureCRDsExistWithRetries(config *rest.Config, retries int) error {
+	return ensureCRDs(apiextensionsclient.NewForConfigOrDie(config), Resources, retries)
 }
 
-func kind(name string) string {
-	parts := strings.Split(name, "-")
-	kindBytes := []byte{}
-	for _, part := range parts {
-		kindBytes = append(kindBytes, []byte(strings.Title(part))...)
+// EnsureCRDsExistFiltered creates only CRDs for given resource names
+func EnsureCRDsExistFiltered(client apiextensionsclient.Interface, names []string) error {
+	defs, err := lookupResources(names)
+	if err != nil {
+		return err
 	}
-	return string(kindBytes)
+	return ensureCRDs(client, defs, DefaultCRDCreateRetries)
 }
 
-func EnsureCRDsExist(config *rest.Config) error {
-	client := apiextensionsclient.NewForConfigOrDie(config)
-	for _, res := range resources {
-		if err := createCRD(client, res); err != nil {
+func ensureCRDs(client apiextensionsclient.Interface, defs []*ResourceDefinition, retries int) error {
+	for _, res := range defs {
+		if err := createCRD(client, res, retries); err != nil {
 			return err
 		}
 	}
@@ -61,68 +153,171 @@ func EnsureCRDsExist(config *rest.Config) error {
 }
 
 func RemoveCRDs(config *rest.Config) error {
-	client := apiextensionsclient.NewForConfigOrDie(config)
-	for _, res := range resources {
-		plural := lowercase(res) + "s"
+	return removeCRDs(apiextensionsclient.NewForConfigOrDie(config), Resources)
+}
+
+// RemoveCRDsFiltered removes only CRDs for given resource names
+func RemoveCRDsFiltered(client apiextensionsclient.Interface, names []string) error {
+	defs, err := lookupResources(names)
+	if err != nil {
+		return err
+	}
+	return removeCRDs(client, defs)
+}
+
+func removeCRDs(client apiextensionsclient.Interface, defs []*ResourceDefinition) error {
+	for _, res := range defs {
 		if err := client.Apiextensions().CustomResourceDefinitions().Delete(
-			fqName(plural), &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			res.CRDName(), &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
 			return err
 		}
 	}
 	return nil
 }
 
-func createCRD(client apiextensionsclient.Interface, name string) error {
-	singular := lowercase(name)
-	plural := singular + "s"
-	crd := &apiextensionsv1beta1.CustomResourceDefinition{
+// lookupResources returns definitions of resources with given names, it is
+// an error if any of the names is unknown
+func lookupResources(names []string) ([]*ResourceDefinition, error) {
+	defs := []*ResourceDefinition{}
+	for _, name := range names {
+		var found *ResourceDefinition
+		for _, res := range Resources {
+			if name == res.Name {
+				found = res
+				break
+			}
+		}
+		if found == nil {
+			known := []string{}
+			for _, res := range Resources {
+				known = append(known, res.Name)
+			}
+			return nil, fmt.Errorf("unknown resource %v, expected one of %v", name, strings.Join(known, ", "))
+		}
+		defs = append(defs, found)
+	}
+	return defs, nil
+}
+
+func createCRD(client apiextensionsclient.Interface, res *ResourceDefinition, retries int) error {
+	backoff := crdCreateBackoff
+	backoff.Steps = retries + 1
+	var err error
+	waitErr := wait.ExponentialBackoff(backoff, func() (bool, error) {
+		_, err = client.Apiextensions().CustomResourceDefinitions().Create(newCRD(res))
+		if err == nil || errors.IsAlreadyExists(err) {
+			return true, nil
+		}
+		if isTransient(err) {
+			glog.V(3).Infof("Retrying creation of custom resource definition %v: %v", res.CRDName(), err)
+			return false, nil
+		}
+		return false, err
+	})
+	if waitErr == wait.ErrWaitTimeout {
+		waitErr = err
+	}
+	if waitErr != nil {
+		return fmt.Errorf("error creating custom resource definition: %v", waitErr)
+	}
+	return nil
+}
+
+// isTransient returns true for errors that may go away on retry, e.g.
+// when api server is not reachable yet or overloaded
+func isTransient(err error) bool {
+	status, ok := err.(errors.APIStatus)
+	if !ok {
+		return true
+	}
+	if errors.IsServerTimeout(err) || errors.IsTimeout(err) || errors.IsInternalError(err) {
+		return true
+	}
+	code := status.Status().Code
+	return code == http.StatusServiceUnavailable || code == http.StatusTooManyRequests
+}
+
+func newCRD(res *ResourceDefinition) *apiextensionsv1beta1.CustomResourceDefinition {
+	return &apiextensionsv1beta1.CustomResourceDefinition{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: fqName(plural),
+			Name: res.CRDName(),
 		},
 		Spec: apiextensionsv1beta1.CustomResourceDefinitionSpec{
-			Group:   GroupName,
-			Version: Version,
-			Scope:   apiextensionsv1beta1.ClusterScoped,
+			Group:   res.Group,
+			Version: res.Version,
+			Scope:   res.Scope,
 			Names: apiextensionsv1beta1.CustomResourceDefinitionNames{
-				Plural:   plural,
-				Singular: singular,
-				Kind:     kind(name),
+				Plural:   res.Plural,
+				Singular: res.Singular,
+				Kind:     res.Kind,
 			},
 		},
 	}
-	_, err := client.Apiextensions().CustomResourceDefinitions().Create(crd)
-	if err != nil && !errors.IsAlreadyExists(err) {
-		return fmt.Errorf("error creating custom resource definition: %v", err)
+}
+
+// VerifyCRDsExist checks that all CRDs are installed and established without
+// creating them, it is used when CRDs are managed by cluster administrator
+func VerifyCRDsExist(config *rest.Config) error {
+	return verifyCRDs(apiextensionsclient.NewForConfigOrDie(config))
+}
+
+func verifyCRDs(client apiextensionsclient.Interface) error {
+	for _, res := range Resources {
+		crd, err := client.Apiextensions().CustomResourceDefinitions().Get(res.CRDName(), metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return fmt.Errorf("CRDs not installed and management disabled: %v is missing", res.CRDName())
+		}
+		if err != nil {
+			return err
+		}
+		if !crdEstablished(crd) {
+			return fmt.Errorf("custom resource definition %v is not established", res.CRDName())
+		}
 	}
 	return nil
 }
 
 func WaitCRDsEstablished(config *rest.Config, timeout time.Duration) error {
 	client := apiextensionsclient.NewForConfigOrDie(config)
-	interval := time.Tick(200 * time.Millisecond)
-	timer := time.After(timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return WaitCRDsEstablishedCtx(ctx, client)
+}
+
+// WaitCRDsEstablishedCtx polls api server until all CRDs are established or
+// ctx is done
+func WaitCRDsEstablishedCtx(ctx context.Context, client apiextensionsclient.Interface) error {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
 	for {
 		select {
-		case <-timer:
-			return fmt.Errorf("timed out waiting for CRDs to get established")
-		case <-interval:
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting for CRDs to get established: %v", ctx.Err())
+		case <-ticker.C:
 			established := 0
-			for _, res := range resources {
-				plural := lowercase(res) + "s"
-				crd, err := client.Apiextensions().CustomResourceDefinitions().Get(fqName(plural), metav1.GetOptions{})
+			for _, res := range Resources {
+				crd, err := client.Apiextensions().CustomResourceDefinitions().Get(res.CRDName(), metav1.GetOptions{})
 				if err != nil {
 					break
 				}
-				for _, condition := range crd.Status.Conditions {
-					if condition.Type == apiextensionsv1beta1.Established &&
-						condition.Status == apiextensionsv1beta1.ConditionTrue {
-						established++
-					}
+				if !crdEstablished(crd) {
+					break
 				}
+				established++
 			}
-			if established == len(resources) {
+			if established == len(Resources) {
 				return nil
 			}
 		}
 	}
 }
+
+func crdEstablished(crd *apiextensionsv1beta1.CustomResourceDefinition) bool {
+	for _, condition := range crd.Status.Conditions {
+		if condition.Type == apiextensionsv1beta1.Established &&
+			condition.Status == apiextensionsv1beta1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,238 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extensions
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	apiextensionsfake "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset/fake"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/pkg/api"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestNewCRD(t *testing.T) {
+	crd := newCRD(&IpClaimResource)
+	assert.Equal(t, "ipclaims.ipcontroller.ext", crd.Name)
+	assert.Equal(t, "ipcontroller.ext", crd.Spec.Group)
+	assert.Equal(t, "IpClaim", crd.Spec.Names.Kind)
+	assert.Equal(t, "ipclaims", crd.Spec.Names.Plural)
+}
+
+func TestResourceDefinitions(t *testing.T) {
+	expected := []struct {
+		name, kind, plural, singular string
+	}{
+		{"ip-node", "IpNode", "ipnodes", "ipnode"},
+		{"ip-claim", "IpClaim", "ipclaims", "ipclaim"},
+		{"ip-claim-pool", "IpClaimPool", "ipclaimpools", "ipclaimpool"},
+	}
+	if !assert.Len(t, Resources, len(expected)) {
+		return
+	}
+	for i, res := range Resources {
+		assert.Equal(t, expected[i].name, res.Name)
+		assert.Equal(t, expected[i].kind, res.Kind)
+		assert.Equal(t, expected[i].plural, res.Plural)
+		assert.Equal(t, expected[i].singular, res.Singular)
+		assert.Equal(t, expected[i].plural+".ipcontroller.ext", res.CRDName())
+		assert.Equal(t, schema.GroupVersionResource{Group: GroupName, Version: Version, Resource: expected[i].plural},
+			res.GroupVersionResource())
+
+		crd := newCRD(res)
+		assert.Equal(t, res.CRDName(), crd.Name)
+		assert.Equal(t, res.Kind, crd.Spec.Names.Kind)
+		assert.Equal(t, res.Plural, crd.Spec.Names.Plural)
+		assert.Equal(t, res.Singular, crd.Spec.Names.Singular)
+	}
+}
+
+func TestSetGroupVersion(t *testing.T) {
+	defer SetGroupVersion(GroupName, Version)
+	SetGroupVersion("ipcontroller.example.com", "v2")
+	assert.Equal(t, "ipclaims.ipcontroller.example.com", IpClaimResource.CRDName())
+	assert.Equal(t, schema.GroupVersionResource{Group: "ipcontroller.example.com", Version: "v2", Resource: "ipnodes"},
+		IpNodeResource.GroupVersionResource())
+	assert.True(t, api.Scheme.Recognizes(schema.GroupVersionKind{Group: "ipcontroller.example.com", Version: "v2", Kind: "IpClaim"}),
+		"Types should be registered for custom group version")
+
+	client := apiextensionsfake.NewSimpleClientset()
+	assert.NoError(t, createCRD(client, &IpClaimResource, 0))
+	crd, err := client.Apiextensions().CustomResourceDefinitions().Get("ipclaims.ipcontroller.example.com", metav1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ipcontroller.example.com", crd.Spec.Group)
+		assert.Equal(t, "v2", crd.Spec.Version)
+	}
+}
+
+func establishedCRD(res *ResourceDefinition, established bool) runtime.Object {
+	crd := newCRD(res)
+	status := apiextensionsv1beta1.ConditionFalse
+	if established {
+		status = apiextensionsv1beta1.ConditionTrue
+	}
+	crd.Status.Conditions = []apiextensionsv1beta1.CustomResourceDefinitionCondition{
+		{Type: apiextensionsv1beta1.NamesAccepted, Status: apiextensionsv1beta1.ConditionTrue},
+		{Type: apiextensionsv1beta1.Established, Status: status},
+	}
+	return crd
+}
+
+func TestWaitCRDsEstablishedCtx(t *testing.T) {
+	client := apiextensionsfake.NewSimpleClientset(
+		establishedCRD(&IpNodeResource, true),
+		establishedCRD(&IpClaimResource, true),
+		establishedCRD(&IpClaimPoolResource, true),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, WaitCRDsEstablishedCtx(ctx, client))
+}
+
+func TestWaitCRDsEstablishedCtxNotEstablished(t *testing.T) {
+	client := apiextensionsfake.NewSimpleClientset(
+		establishedCRD(&IpNodeResource, true),
+		establishedCRD(&IpClaimResource, false),
+		establishedCRD(&IpClaimPoolResource, true),
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	assert.Error(t, WaitCRDsEstablishedCtx(ctx, client))
+}
+
+func TestWaitCRDsEstablishedCtxCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	assert.Error(t, WaitCRDsEstablishedCtx(ctx, apiextensionsfake.NewSimpleClientset()))
+	assert.True(t, time.Since(start) < 100*time.Millisecond, "Cancelled wait should return promptly")
+}
+
+func TestVerifyCRDs(t *testing.T) {
+	client := apiextensionsfake.NewSimpleClientset(
+		establishedCRD(&IpNodeResource, true),
+		establishedCRD(&IpClaimResource, true),
+		establishedCRD(&IpClaimPoolResource, true),
+	)
+	assert.NoError(t, verifyCRDs(client))
+	for _, action := range client.Actions() {
+		assert.Equal(t, "get", action.GetVerb(), "CRDs should only be read")
+	}
+
+	client = apiextensionsfake.NewSimpleClientset(
+		establishedCRD(&IpNodeResource, true),
+		establishedCRD(&IpClaimPoolResource, true),
+	)
+	err := verifyCRDs(client)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "CRDs not installed and management disabled")
+		assert.Contains(t, err.Error(), "ipclaims.ipcontroller.ext")
+	}
+	for _, action := range client.Actions() {
+		assert.Equal(t, "get", action.GetVerb(), "Missing CRDs should not be created")
+	}
+
+	client = apiextensionsfake.NewSimpleClientset(
+		establishedCRD(&IpNodeResource, true),
+		establishedCRD(&IpClaimResource, false),
+		establishedCRD(&IpClaimPoolResource, true),
+	)
+	assert.Error(t, verifyCRDs(client))
+}
+
+func TestEnsureCRDsExistFiltered(t *testing.T) {
+	client := apiextensionsfake.NewSimpleClientset()
+	assert.NoError(t, EnsureCRDsExistFiltered(client, []string{"ip-node", "ip-claim"}))
+	crds, err := client.Apiextensions().CustomResourceDefinitions().List(metav1.ListOptions{})
+	assert.NoError(t, err)
+	names := []string{}
+	for _, crd := range crds.Items {
+		names = append(names, crd.Name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"ipclaims.ipcontroller.ext", "ipnodes.ipcontroller.ext"}, names)
+
+	assert.NoError(t, RemoveCRDsFiltered(client, []string{"ip-claim"}))
+	crds, err = client.Apiextensions().CustomResourceDefinitions().List(metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, crds.Items, 1)
+}
+
+func TestEnsureCRDsExistFilteredUnknown(t *testing.T) {
+	client := apiextensionsfake.NewSimpleClientset()
+	assert.Error(t, EnsureCRDsExistFiltered(client, []string{"ip-node", "ip-pool"}))
+	assert.Empty(t, client.Actions(), "No CRDs should be created if a resource is unknown")
+	assert.Error(t, RemoveCRDsFiltered(client, []string{"unknown"}))
+}
+
+func TestCRDScopes(t *testing.T) {
+	defer func() {
+		IpClaimResource.Scope = apiextensionsv1beta1.ClusterScoped
+		IpClaimPoolResource.Scope = apiextensionsv1beta1.ClusterScoped
+		claimsNamespace = "default"
+	}()
+	for _, res := range Resources {
+		assert.Equal(t, apiextensionsv1beta1.ClusterScoped, newCRD(res).Spec.Scope,
+			"Unexpected default scope of %v", res.Name)
+	}
+
+	SetNamespacedClaims("tenant")
+	assert.Equal(t, apiextensionsv1beta1.ClusterScoped, newCRD(&IpNodeResource).Spec.Scope)
+	assert.Equal(t, apiextensionsv1beta1.NamespaceScoped, newCRD(&IpClaimResource).Spec.Scope)
+	assert.Equal(t, apiextensionsv1beta1.NamespaceScoped, newCRD(&IpClaimPoolResource).Spec.Scope)
+	assert.Equal(t, "tenant", claimsNamespace)
+}
+
+func failingCreates(client *apiextensionsfake.Clientset, failures int, err error) *int {
+	calls := 0
+	client.PrependReactor("create", "customresourcedefinitions", func(clienttesting.Action) (bool, runtime.Object, error) {
+		calls++
+		if calls <= failures {
+			return true, nil, err
+		}
+		return false, nil, nil
+	})
+	return &calls
+}
+
+func TestCreateCRDRetries(t *testing.T) {
+	defer func(d time.Duration) { crdCreateBackoff.Duration = d }(crdCreateBackoff.Duration)
+	crdCreateBackoff.Duration = time.Millisecond
+
+	client := apiextensionsfake.NewSimpleClientset()
+	calls := failingCreates(client, 2, errors.NewServerTimeout(schema.GroupResource{}, "create", 1))
+	assert.NoError(t, createCRD(client, &IpClaimResource, 3))
+	assert.Equal(t, 3, *calls)
+	_, err := client.Apiextensions().CustomResourceDefinitions().Get("ipclaims.ipcontroller.ext", metav1.GetOptions{})
+	assert.NoError(t, err, "CRD should be created after retries")
+
+	client = apiextensionsfake.NewSimpleClientset()
+	calls = failingCreates(client, 5, errors.NewServerTimeout(schema.GroupResource{}, "create", 1))
+	assert.Error(t, createCRD(client, &IpClaimResource, 2))
+	assert.Equal(t, 3, *calls, "Creation should not be retried more than requested")
+
+	client = apiextensionsfake.NewSimpleClientset()
+	calls = failingCreates(client, 1, errors.NewBadRequest("invalid"))
+	assert.Error(t, createCRD(client, &IpClaimResource, 3))
+	assert.Equal(t, 1, *calls, "Validation errors should not be retried")
+}
@@ -121,6 +121,10 @@ func (f *fakeIpClaimPools) List(opts metav1.ListOptions) (*extensions.IpClaimPoo
 	return args.Get(0).(*extensions.IpClaimPoolList), args.Error(1)
 }
 
+func (f *fakeIpClaimPools) Watch(_ metav1.ListOptions) (watch.Interface, error) {
+	return nil, nil
+}
+
 func (f *fakeIpClaimPools) Update(ipclaimpool *extensions.IpClaimPool) (*extensions.IpClaimPool, error) {
 	args := f.Called(ipclaimpool)
 	return args.Get(0).(*extensions.IpClaimPool), args.Error(1)
@@ -31,6 +31,10 @@ import (
 const (
 	GroupName string = "ipcontroller.ext"
 	Version   string = "v1"
+
+	// IpClaimFinalizer is set by claim controller on claims assigned to its
+	// node, so an IP is removed from the node before its claim disappears
+	IpClaimFinalizer = GroupName + "/cleanup"
 )
 
 var (
@@ -104,6 +108,8 @@ type IpClaim struct {
 	Metadata metav1.ObjectMeta `json:"metadata,omitempty" protobuf:"bytes,1,opt,name=metadata"`
 
 	Spec IpClaimSpec `json:"spec,omitempty" protobuf:"bytes,2,opt,name=spec"`
+
+	Status IpClaimStatus `json:"status,omitempty" protobuf:"bytes,3,opt,name=status"`
 }
 
 func (e *IpClaim) GetObjectKind() schema.ObjectKind {
@@ -114,6 +120,42 @@ func (e *IpClaim) GetObjectMeta() metav1.Object {
 	return &e.Metadata
 }
 
+// HasFinalizer returns true if claim has IpClaimFinalizer
+func (e *IpClaim) HasFinalizer() bool {
+	for _, f := range e.Metadata.Finalizers {
+		if f == IpClaimFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// ResetStatus marks claim as unassigned when it is scheduled, node that
+// had the IP assigned is kept as a previous one
+func (e *IpClaim) ResetStatus() {
+	previous := e.Status.NodeName
+	if previous == "" {
+		previous = e.Status.PreviousNodeName
+	}
+	e.Status = IpClaimStatus{State: IpClaimUnassigned, PreviousNodeName: previous}
+}
+
+// WasAssigned returns true if IP of a claim was assigned on some node before
+func (e *IpClaim) WasAssigned() bool {
+	return e.Status.NodeName != "" || e.Status.PreviousNodeName != ""
+}
+
+// RemoveFinalizer removes IpClaimFinalizer from a claim
+func (e *IpClaim) RemoveFinalizer() {
+	finalizers := []string{}
+	for _, f := range e.Metadata.Finalizers {
+		if f != IpClaimFinalizer {
+			finalizers = append(finalizers, f)
+		}
+	}
+	e.Metadata.Finalizers = finalizers
+}
+
 type IpClaimList struct {
 	metav1.TypeMeta `json:",inline"`
 
@@ -128,6 +170,30 @@ type IpClaimSpec struct {
 	NodeName string `json:"nodeName" protobuf:"bytes,10,opt,name=nodeName"`
 	Cidr     string `json:"cidr,omitempty" protobuf:"bytes,10,opt,name=cidr"`
 	Link     string `json:"link" protobuf:"bytes,10,opt,name=link"`
+	// NodeSelector restricts nodes claim can be scheduled on to IPNodes
+	// with matching labels
+	NodeSelector map[string]string `json:"nodeSelector,omitempty" protobuf:"bytes,11,rep,name=nodeSelector"`
+	// Group is a name shared by claims that must be scheduled on the same
+	// node, claims of a group are placed and moved together
+	Group string `json:"group,omitempty" protobuf:"bytes,12,opt,name=group"`
+}
+
+const (
+	// IpClaimAssigned state means that IP is assigned on Status.NodeName
+	IpClaimAssigned = "Assigned"
+	// IpClaimUnassigned state means that claim waits for its node to
+	// assign IP
+	IpClaimUnassigned = "Unassigned"
+)
+
+type IpClaimStatus struct {
+	// NodeName of a node that has assigned the IP
+	NodeName   string      `json:"nodeName,omitempty" protobuf:"bytes,1,opt,name=nodeName"`
+	AssignedAt metav1.Time `json:"assignedAt,omitempty" protobuf:"bytes,2,opt,name=assignedAt"`
+	State      string      `json:"state,omitempty" protobuf:"bytes,3,opt,name=state"`
+	// PreviousNodeName of a node that had the IP assigned before the claim
+	// was scheduled again
+	PreviousNodeName string `json:"previousNodeName,omitempty" protobuf:"bytes,4,opt,name=previousNodeName"`
 }
 
 type IpClaimPool struct {
@@ -143,6 +209,8 @@ type IpClaimPoolSpec struct {
 	CIDR      string            `json:"cidr" protobuf:"bytes,10,opt,name=cidr"`
 	Ranges    [][]string        `json:"ranges,omitempty" protobuf:"bytes,5,opt,name=ranges"`
 	Allocated map[string]string `json:"allocated,omitempty" protobuf:"bytes,2,opt,name=allocated"`
+	// NodeSelector is set on claims for IPs allocated from the pool
+	NodeSelector map[string]string `json:"nodeSelector,omitempty" protobuf:"bytes,11,rep,name=nodeSelector"`
 }
 
 type IpClaimPoolList struct {
@@ -201,6 +269,20 @@ func (p *IpClaimPool) AvailableIP() (availableIP string, err error) {
 	return "", errors.New("There is no free IP left in the pool")
 }
 
+// Overlaps returns true if CIDR of the pool shares at least one address
+// with CIDR of other pool
+func (p *IpClaimPool) Overlaps(other *IpClaimPool) (bool, error) {
+	_, network, err := net.ParseCIDR(p.Spec.CIDR)
+	if err != nil {
+		return false, err
+	}
+	_, otherNetwork, err := net.ParseCIDR(other.Spec.CIDR)
+	if err != nil {
+		return false, err
+	}
+	return network.Contains(otherNetwork.IP) || otherNetwork.Contains(network.IP), nil
+}
+
 func (p *IpClaimPool) GetObjectKind() schema.ObjectKind {
 	return &p.TypeMeta
 }
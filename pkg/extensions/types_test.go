@@ -125,3 +125,54 @@ func TestIpClaimPoolRangesProperlyProcessed(t *testing.T) {
 
 	checkNoFreeIPError(t, ClaimPool)
 }
+
+func TestIpClaimPoolSmallNetwork(t *testing.T) {
+	pool := &IpClaimPool{
+		Spec: IpClaimPoolSpec{
+			CIDR:      "10.20.0.0/30",
+			Allocated: map[string]string{},
+		},
+	}
+
+	checkFreeIP(t, pool, "10.20.0.1")
+	pool.Spec.Allocated["10.20.0.1"] = "test-claim-1"
+	checkFreeIP(t, pool, "10.20.0.2")
+	pool.Spec.Allocated["10.20.0.2"] = "test-claim-2"
+
+	// network and broadcast addresses are never allocated
+	checkNoFreeIPError(t, pool)
+
+	delete(pool.Spec.Allocated, "10.20.0.1")
+	checkFreeIP(t, pool, "10.20.0.1")
+}
+
+func TestIpClaimPoolOverlaps(t *testing.T) {
+	testCases := []struct {
+		first, second string
+		overlaps      bool
+	}{
+		{"10.20.0.0/30", "10.30.0.0/30", false},
+		{"10.20.0.0/30", "10.20.0.4/30", false},
+		{"10.20.0.4/30", "10.20.0.0/30", false},
+		{"10.20.0.0/30", "10.20.0.2/31", true},
+		{"10.20.0.0/24", "10.20.0.128/25", true},
+		{"10.20.0.128/25", "10.20.0.0/24", true},
+		{"10.20.0.0/24", "10.20.0.0/24", true},
+	}
+	for _, tc := range testCases {
+		first := &IpClaimPool{Spec: IpClaimPoolSpec{CIDR: tc.first}}
+		second := &IpClaimPool{Spec: IpClaimPoolSpec{CIDR: tc.second}}
+		overlaps, err := first.Overlaps(second)
+		if err != nil {
+			t.Errorf("Unexpected error for %v and %v: %v", tc.first, tc.second, err)
+		}
+		if overlaps != tc.overlaps {
+			t.Errorf("Expected overlap of %v and %v to be %v", tc.first, tc.second, tc.overlaps)
+		}
+	}
+
+	invalid := &IpClaimPool{Spec: IpClaimPoolSpec{CIDR: "10.20.0.0"}}
+	if _, err := invalid.Overlaps(invalid); err == nil {
+		t.Error("Overlaps must return error for invalid CIDR")
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Status keeps liveness and readiness state of the application
+type Status struct {
+	alive int32
+	ready int32
+
+	// Check is called on every readiness probe after application became
+	// ready, e.g. to verify that kubernetes api is still reachable
+	Check func() error
+}
+
+// SetAlive marks that main loops of the application are running
+func (s *Status) SetAlive() {
+	atomic.StoreInt32(&s.alive, 1)
+}
+
+// SetReady marks that application is connected and CRDs are established
+func (s *Status) SetReady() {
+	atomic.StoreInt32(&s.ready, 1)
+}
+
+func (s *Status) Healthz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.alive) == 0 {
+		http.Error(w, "not running", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
+
+func (s *Status) Readyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.ready) == 0 {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	if s.Check != nil {
+		if err := s.Check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprint(w, "ok")
+}
+
+// InstallHandlers registers /healthz and /readyz on a given mux
+func (s *Status) InstallHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", s.Healthz)
+	mux.HandleFunc("/readyz", s.Readyz)
+}
@@ -0,0 +1,53 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func probe(s *Status, path string) int {
+	mux := http.NewServeMux()
+	s.InstallHandlers(mux)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec.Code
+}
+
+func TestProbes(t *testing.T) {
+	var checkErr error
+	s := &Status{Check: func() error { return checkErr }}
+	for _, step := range []struct {
+		name            string
+		update          func()
+		healthz, readyz int
+	}{
+		{"starting", func() {}, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+		{"running", s.SetAlive, http.StatusOK, http.StatusServiceUnavailable},
+		{"ready", s.SetReady, http.StatusOK, http.StatusOK},
+		{"disconnected", func() { checkErr = errors.New("connection refused") },
+			http.StatusOK, http.StatusServiceUnavailable},
+		{"reconnected", func() { checkErr = nil }, http.StatusOK, http.StatusOK},
+	} {
+		step.update()
+		assert.Equal(t, step.healthz, probe(s, "/healthz"), "Unexpected /healthz status while %s", step.name)
+		assert.Equal(t, step.readyz, probe(s, "/readyz"), "Unexpected /readyz status while %s", step.name)
+	}
+}
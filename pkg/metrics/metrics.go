@@ -0,0 +1,119 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"sync"
+
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/version"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "externalip"
+
+const (
+	ResultFit   = "fit"
+	ResultNoFit = "nofit"
+	ResultError = "error"
+
+	AssignInitial = "initial"
+	AssignReclaim = "reclaim"
+)
+
+var (
+	// ScheduleDecisions counts attempts to find a node for IP claim
+	ScheduleDecisions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "schedule_decisions_total",
+			Help:      "Number of attempts to schedule IP claim on a node by result.",
+		},
+		[]string{"result"},
+	)
+	// ClaimsPerNode shows how many IP claims are scheduled on every node
+	ClaimsPerNode = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "claims_per_node",
+			Help:      "Number of IP claims currently scheduled on a node.",
+		},
+		[]string{"node"},
+	)
+	// AssignQueueLength shows how many claims wait for processing by
+	// a claim controller
+	AssignQueueLength = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "assign_queue_length",
+			Help:      "Number of IP claims waiting to be assigned or removed on a node.",
+		},
+	)
+	// AssignQueueOldestAge shows how long the oldest claim waits for
+	// processing by a claim controller
+	AssignQueueOldestAge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "assign_queue_oldest_seconds",
+			Help:      "Time the oldest IP claim waits in the queue to be assigned or removed on a node.",
+		},
+	)
+	// AssignLatency tracks how long it takes from a claim appearing on a node
+	// to its IP being assigned
+	AssignLatency = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "assign_seconds",
+			Help:      "Time from IP claim being observed by a node to IP assigned on its interface.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"kind"},
+	)
+	// BuildInfo is always 1, labels describe the running build
+	BuildInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "build_info",
+			Help:      "Build information of the running binary.",
+		},
+		[]string{"version", "commit", "build_date"},
+	)
+	// ClaimUpdateLatency tracks how long it takes to persist IP claim changes
+	ClaimUpdateLatency = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "claim_update_duration_seconds",
+			Help:      "Latency of IP claim updates sent to the API server.",
+			Buckets:   prometheus.DefBuckets,
+		},
+	)
+)
+
+var registerOnce sync.Once
+
+// Register adds all collectors to the default prometheus registry.
+// Collectors are usable without registration, so tests don't need to call it.
+func Register() {
+	registerOnce.Do(func() {
+		prometheus.MustRegister(ScheduleDecisions)
+		prometheus.MustRegister(ClaimsPerNode)
+		prometheus.MustRegister(ClaimUpdateLatency)
+		prometheus.MustRegister(AssignQueueLength)
+		prometheus.MustRegister(AssignQueueOldestAge)
+		prometheus.MustRegister(AssignLatency)
+		prometheus.MustRegister(BuildInfo)
+		BuildInfo.WithLabelValues(version.Version, version.GitCommit, version.BuildDate).Set(1)
+	})
+}
@@ -0,0 +1,61 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"testing"
+
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/version"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRegister(t *testing.T) {
+	Register()
+	// second call must not panic on duplicate registration
+	Register()
+	ScheduleDecisions.WithLabelValues(ResultFit).Inc()
+	ClaimsPerNode.WithLabelValues("first").Set(2)
+	AssignLatency.WithLabelValues(AssignInitial).Observe(0.1)
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	gathered := map[string]bool{}
+	for _, family := range families {
+		gathered[family.GetName()] = true
+		if family.GetName() != "externalip_build_info" {
+			continue
+		}
+		labels := map[string]string{}
+		for _, pair := range family.GetMetric()[0].GetLabel() {
+			labels[pair.GetName()] = pair.GetValue()
+		}
+		if labels["version"] != version.Version {
+			t.Errorf("Expected build version %v, got %v", version.Version, labels["version"])
+		}
+	}
+	for _, name := range []string{
+		"externalip_schedule_decisions_total",
+		"externalip_claims_per_node",
+		"externalip_assign_seconds",
+		"externalip_build_info",
+	} {
+		if !gathered[name] {
+			t.Errorf("Metric %v is not registered", name)
+		}
+	}
+}
@@ -15,7 +15,17 @@
 package netutils
 
 import (
+	"context"
+	"fmt"
+	"hash/fnv"
 	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/vishvananda/netlink"
@@ -56,7 +66,50 @@ func writeARP(handle *pcap.Handle, iface *net.Interface, addr *net.IPNet) error
 	return nil
 }
 
+// writeNA sends unsolicited neighbor advertisement for an IPv6 address
+// to all-nodes multicast group
+func writeNA(handle *pcap.Handle, iface *net.Interface, addr *net.IPNet) error {
+	eth := layers.Ethernet{
+		SrcMAC:       iface.HardwareAddr,
+		DstMAC:       net.HardwareAddr{0x33, 0x33, 0x00, 0x00, 0x00, 0x01},
+		EthernetType: layers.EthernetTypeIPv6,
+	}
+	ip6 := layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolICMPv6,
+		HopLimit:   255,
+		SrcIP:      addr.IP,
+		DstIP:      net.IPv6linklocalallnodes,
+	}
+	icmp := layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborAdvertisement, 0),
+	}
+	icmp.SetNetworkLayerForChecksum(&ip6)
+	// override flag, target address and target link-layer address option
+	body := []byte{0x20, 0, 0, 0}
+	body = append(body, addr.IP.To16()...)
+	body = append(body, 2, 1)
+	body = append(body, iface.HardwareAddr...)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{
+		FixLengths:       true,
+		ComputeChecksums: true,
+	}
+	gopacket.SerializeLayers(buf, opts, &eth, &ip6, &icmp, gopacket.Payload(body))
+	return handle.WritePacketData(buf.Bytes())
+}
+
 func ArpAnnouncement(ifname string, addr *net.IPNet) error {
+	return Announce(ifname, addr, 1)
+}
+
+// Announce sends count gratuitous ARP packets (or unsolicited neighbor
+// advertisements for IPv6) for addr, so peers update their caches after
+// failover
+func Announce(ifname string, addr *net.IPNet, count int) error {
+	if count < 1 {
+		return nil
+	}
 	iface, err := net.InterfaceByName(ifname)
 	if err != nil {
 		return err
@@ -66,36 +119,147 @@ func ArpAnnouncement(ifname string, addr *net.IPNet) error {
 		return err
 	}
 	defer handle.Close()
-	return writeARP(handle, iface, addr)
+	write := writeARP
+	if family(addr.IP) == netlink.FAMILY_V6 {
+		write = writeNA
+	}
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(announceInterval)
+		}
+		if err := write(handle, iface, addr); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// EnsureIPAssigned will check if ip is already present on a given link
-func EnsureIPAssigned(iface, cidr string) error {
-	link, err := netlink.LinkByName(iface)
-	if err != nil {
-		return err
+// family returns netlink address family of an ip
+func family(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
+
+const (
+	// DefaultGARPCount is a number of announcements sent for a new address
+	DefaultGARPCount = 3
+
+	announceInterval = 200 * time.Millisecond
+)
+
+var (
+	// overridden in tests
+	addIP    = addIPIfMissing
+	announce = Announce
+)
+
+// ifaNoPrefixRoute is IFA_F_NOPREFIXROUTE address flag, it is missing in
+// syscall package
+const ifaNoPrefixRoute = 0x200
+
+// AddrOptions are attributes of addresses added to links
+type AddrOptions struct {
+	// Scope of an address, e.g. netlink.SCOPE_HOST
+	Scope int
+	// NoPrefixRoute prevents kernel from adding a route to address subnet
+	NoPrefixRoute bool
+}
+
+var addrScopes = map[string]int{
+	"global": int(netlink.SCOPE_UNIVERSE),
+	"site":   int(netlink.SCOPE_SITE),
+	"link":   int(netlink.SCOPE_LINK),
+	"host":   int(netlink.SCOPE_HOST),
+}
+
+// ParseAddrScope returns scope by name as used by iproute2, empty name is
+// the global scope
+func ParseAddrScope(name string) (int, error) {
+	if name == "" {
+		return int(netlink.SCOPE_UNIVERSE), nil
+	}
+	scope, exists := addrScopes[name]
+	if !exists {
+		return 0, fmt.Errorf("Unknown address scope '%v', expected global, site, link or host", name)
 	}
+	return scope, nil
+}
+
+// addIPIfMissing adds cidr to a given link, returned network is nil if cidr
+// was already present there. It is an error if the IP is already assigned
+// to another link
+func addIPIfMissing(iface, cidr string, opts AddrOptions) (*net.IPNet, error) {
 	addr, err := netlink.ParseAddr(cidr)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	addr.Scope = opts.Scope
+	if opts.NoPrefixRoute {
+		addr.Flags |= ifaNoPrefixRoute
 	}
-	addrList, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	addr.Peer = pointToPointPeer(addr.IPNet)
+	addrs, err := listAddrs()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for i := range addrList {
-		if addrList[i].IPNet.String() == addr.IPNet.String() {
-			return nil
+	for _, present := range addrs {
+		if !present.Network.IP.Equal(addr.IP) {
+			continue
+		}
+		if present.Link != iface {
+			return nil, fmt.Errorf("IP %v is already assigned to link %v", addr.IP, present.Link)
+		}
+		if present.Network.String() == addr.IPNet.String() {
+			glog.V(4).Infof("IP %v is already present on link %v", cidr, iface)
+			return nil, nil
 		}
 	}
-	err = netlink.AddrAdd(link, addr)
+	link, err := linkByName(iface)
 	if err != nil {
+		return nil, err
+	}
+	if err := addrAdd(link, addr); err != nil {
+		if err == syscall.EEXIST {
+			glog.V(4).Infof("IP %v was added to link %v concurrently", cidr, iface)
+			return nil, nil
+		}
+		return nil, err
+	}
+	return addr.IPNet, nil
+}
+
+// pointToPointPeer returns the other address of a /31 (or /127) network as
+// defined by RFC 3021, such networks have no broadcast address. It returns
+// nil for other networks
+func pointToPointPeer(network *net.IPNet) *net.IPNet {
+	ones, bits := network.Mask.Size()
+	if ones != bits-1 {
+		return nil
+	}
+	peer := make(net.IP, len(network.IP))
+	copy(peer, network.IP)
+	peer[len(peer)-1] ^= 1
+	return &net.IPNet{IP: peer, Mask: network.Mask}
+}
+
+// EnsureIPAssigned will check if ip is already present on a given link
+func EnsureIPAssigned(iface, cidr string) error {
+	return ensureIPAssigned(iface, cidr, DefaultGARPCount, AddrOptions{})
+}
+
+// ensureIPAssigned assigns cidr to a link and announces it garpCount times
+// if it was not assigned before
+func ensureIPAssigned(iface, cidr string, garpCount int, opts AddrOptions) error {
+	network, err := addIP(iface, cidr, opts)
+	if err != nil || network == nil {
 		return err
 	}
-	if iface != "lo" {
-		return ArpAnnouncement(iface, addr.IPNet)
+	if iface == "lo" {
+		return nil
 	}
-	return nil
+	return announce(iface, network, garpCount)
 }
 
 // EnsureIPUnassigned ensure that given IP is not present on a given link
@@ -108,7 +272,7 @@ func EnsureIPUnassigned(iface, cidr string) error {
 	if err != nil {
 		return err
 	}
-	addrList, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	addrList, err := netlink.AddrList(link, family(addr.IP))
 	if err != nil {
 		return err
 	}
@@ -125,17 +289,559 @@ type IPHandler interface {
 	Del(iface, cidr string) error
 }
 
-type LinuxIPHandler struct{}
+// LinuxIPHandler manages addresses with netlink, GARPCount announcements
+// are sent for each added address
+type LinuxIPHandler struct {
+	GARPCount   int
+	AddrOptions AddrOptions
+}
 
 func (l LinuxIPHandler) Add(iface, cidr string) error {
+	if IsSubnet(cidr) {
+		// an address does not make node respond for other IPs of a subnet
+		return RouteIPHandler{}.Add(iface, cidr)
+	}
 	glog.V(2).Infof("Adding addr %v on link %v", cidr, iface)
-	return EnsureIPAssigned(iface, cidr)
+	return ensureIPAssigned(iface, cidr, l.GARPCount, l.AddrOptions)
 }
 func (l LinuxIPHandler) Del(iface, cidr string) error {
+	if IsSubnet(cidr) {
+		return RouteIPHandler{}.Del(iface, cidr)
+	}
 	glog.V(2).Infof("Removing addr %v from link %v", cidr, iface)
 	return EnsureIPUnassigned(iface, cidr)
 }
 
+// maxSubnetSize caps size of a subnet reported by SubnetSize
+const maxSubnetSize = 1 << 16
+
+// IsSubnet returns true if cidr is a network address with a prefix shorter
+// than a host one, e.g. 10.10.0.0/28. Such cidrs are assigned as a block
+// with a local route, so node responds for every address of the subnet
+func IsSubnet(cidr string) bool {
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	ones, bits := network.Mask.Size()
+	return ones < bits && ip.Equal(network.IP)
+}
+
+// SubnetSize returns number of addresses in a subnet cidr capped at 65536,
+// it is 1 for single IPs
+func SubnetSize(cidr string) int {
+	if !IsSubnet(cidr) {
+		return 1
+	}
+	_, network, _ := net.ParseCIDR(cidr)
+	ones, bits := network.Mask.Size()
+	if bits-ones >= 16 {
+		return maxSubnetSize
+	}
+	return 1 << uint(bits-ones)
+}
+
+// AssignMode values select how external IPs are assigned to a node
+const (
+	AssignModeAddr  = "addr"
+	AssignModeRoute = "route"
+)
+
+var (
+	// overridden in tests
+	linkByName = netlink.LinkByName
+	linkAdd    = netlink.LinkAdd
+	linkDel    = netlink.LinkDel
+	linkSetUp  = netlink.LinkSetUp
+	linkSetMTU = netlink.LinkSetMTU
+	routeAdd   = netlink.RouteAdd
+	routeDel   = netlink.RouteDel
+	addrAdd    = netlink.AddrAdd
+	linkList   = netlink.LinkList
+	listAddrs  = ListLinkAddrs
+	// overridden in tests
+	linkByIndex = netlink.LinkByIndex
+	routeList   = netlink.RouteListFiltered
+)
+
+// EnsureDummyLink creates dummy link with a given name if there is no such
+// link and brings it up. It returns true if the link was created
+func EnsureDummyLink(name string) (bool, error) {
+	created := false
+	link, err := linkByName(name)
+	if err != nil {
+		glog.V(2).Infof("Creating dummy link %v", name)
+		if addErr := linkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}}); addErr != nil {
+			return false, fmt.Errorf("Error creating link %v: %v, lookup error: %v", name, addErr, err)
+		}
+		created = true
+		if link, err = linkByName(name); err != nil {
+			return created, err
+		}
+	}
+	return created, linkSetUp(link)
+}
+
+// CheckLink returns an error if there is no link with a given name
+func CheckLink(name string) error {
+	_, err := linkByName(name)
+	return err
+}
+
+// RemoveLink removes a link with a given name
+func RemoveLink(name string) error {
+	link, err := linkByName(name)
+	if err != nil {
+		return err
+	}
+	glog.V(2).Infof("Removing link %v", name)
+	return linkDel(link)
+}
+
+// CheckNetAdmin verifies that links can be changed over netlink, i.e. that
+// process has CAP_NET_ADMIN capability. MTU of loopback is set to its
+// current value, so nothing is changed
+func CheckNetAdmin() error {
+	link, err := linkByName("lo")
+	if err != nil {
+		return err
+	}
+	err = linkSetMTU(link, link.Attrs().MTU)
+	if err == syscall.EPERM {
+		return fmt.Errorf("missing CAP_NET_ADMIN capability, it is required to manage IPs: %v", err)
+	}
+	return err
+}
+
+// RouteIPHandler installs external IPs as local host routes on a link
+// instead of addresses. Such IPs are not announced with ARP, they are
+// expected to be advertised by a routing daemon (e.g. BGP speaker)
+type RouteIPHandler struct {
+	// Table is a routing table for IP routes, local table is used if 0
+	Table int
+	// SrcVIP sets preferred source of a route to the IP itself, so replies
+	// are sent from the external IP rather than node primary address
+	SrcVIP bool
+}
+
+func (r RouteIPHandler) Add(iface, cidr string) error {
+	glog.V(2).Infof("Adding route for %v via link %v", cidr, iface)
+	route, err := hostRoute(iface, cidr, r.Table)
+	if err != nil {
+		return err
+	}
+	if r.SrcVIP && !IsSubnet(cidr) {
+		route.Src = route.Dst.IP
+	}
+	if err := routeAdd(route); err != nil && err != syscall.EEXIST {
+		return err
+	}
+	return nil
+}
+
+func (r RouteIPHandler) Del(iface, cidr string) error {
+	glog.V(2).Infof("Removing route for %v via link %v", cidr, iface)
+	route, err := hostRoute(iface, cidr, r.Table)
+	if err != nil {
+		return err
+	}
+	if err := routeDel(route); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
+// hostRoute returns local route to a single IP of a cidr on a given link,
+// or to the whole cidr if it is a subnet. Route is placed to the local table
+// if table is 0
+func hostRoute(iface, cidr string, table int) (*netlink.Route, error) {
+	link, err := linkByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := RouteDst(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if table == 0 {
+		table = syscall.RT_TABLE_LOCAL
+	}
+	return &netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       dst,
+		Scope:     netlink.SCOPE_HOST,
+		Table:     table,
+		Type:      syscall.RTN_LOCAL,
+	}, nil
+}
+
+// RouteDst returns destination of a route that is installed for a cidr,
+// it is the whole cidr for subnets and a single IP otherwise
+func RouteDst(cidr string) (*net.IPNet, error) {
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if IsSubnet(cidr) {
+		return network, nil
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// ListLocalRoutes returns local routes of a routing table in the same form
+// as link addresses, local table is used if table is 0. Routes that kernel
+// creates for link addresses are skipped, so only routes of IPs assigned in
+// route mode and subnets are returned
+func ListLocalRoutes(table int) ([]LinkAddr, error) {
+	if table == 0 {
+		table = syscall.RT_TABLE_LOCAL
+	}
+	filter := &netlink.Route{Table: table, Type: syscall.RTN_LOCAL}
+	routes, err := routeList(netlink.FAMILY_ALL, filter, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_TYPE)
+	if err != nil {
+		return nil, err
+	}
+	names := map[int]string{}
+	result := []LinkAddr{}
+	for _, route := range routes {
+		if route.Dst == nil || route.Protocol == syscall.RTPROT_KERNEL {
+			continue
+		}
+		name, exists := names[route.LinkIndex]
+		if !exists {
+			link, err := linkByIndex(route.LinkIndex)
+			if err != nil {
+				return nil, err
+			}
+			name = link.Attrs().Name
+			names[route.LinkIndex] = name
+		}
+		result = append(result, LinkAddr{Link: name, Network: route.Dst})
+	}
+	return result, nil
+}
+
+// LinkAddr is a network configured on a link
+type LinkAddr struct {
+	Link    string
+	Network *net.IPNet
+}
+
+// ListLinkAddrs returns networks configured on all links of a node
+func ListLinkAddrs() ([]LinkAddr, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	result := []LinkAddr{}
+	for _, link := range links {
+		addrList, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return nil, err
+		}
+		for i := range addrList {
+			result = append(result, LinkAddr{Link: link.Attrs().Name, Network: addrList[i].IPNet})
+		}
+	}
+	return result, nil
+}
+
+// LinkForIP returns first link that has a network containing ip or fallback
+// if there is no such link
+func LinkForIP(ip net.IP, addrs []LinkAddr, fallback string) string {
+	for _, addr := range addrs {
+		if addr.Network.IP.IsLoopback() {
+			continue
+		}
+		if addr.Network.Contains(ip) {
+			return addr.Link
+		}
+	}
+	return fallback
+}
+
+// AutoIfaceIPHandler selects link based on a subnet of a cidr and passes
+// it to a wrapped handler instead of a provided one
+type AutoIfaceIPHandler struct {
+	Handler   IPHandler
+	ListAddrs func() ([]LinkAddr, error)
+}
+
+func (a AutoIfaceIPHandler) Add(iface, cidr string) error {
+	return a.Handler.Add(a.selectIface(iface, cidr), cidr)
+}
+
+func (a AutoIfaceIPHandler) Del(iface, cidr string) error {
+	return a.Handler.Del(a.selectIface(iface, cidr), cidr)
+}
+
+func (a AutoIfaceIPHandler) selectIface(iface, cidr string) string {
+	ip, _, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return iface
+	}
+	addrs, err := a.ListAddrs()
+	if err != nil {
+		glog.Errorf("Error listing addresses, %v will be used for %v: %v", iface, cidr, err)
+		return iface
+	}
+	selected := LinkForIP(ip, addrs, iface)
+	glog.V(5).Infof("Link %v was selected for %v", selected, cidr)
+	return selected
+}
+
+// SplitIfaces returns links from a comma separated list
+func SplitIfaces(ifaces string) []string {
+	result := []string{}
+	for _, iface := range strings.Split(ifaces, ",") {
+		if iface = strings.TrimSpace(iface); iface != "" {
+			result = append(result, iface)
+		}
+	}
+	return result
+}
+
+// IfaceForCIDR selects one of links by a hash of cidr, so the same cidr is
+// always assigned to the same link
+func IfaceForCIDR(ifaces []string, cidr string) string {
+	if len(ifaces) == 0 {
+		return ""
+	}
+	h := fnv.New32a()
+	h.Write([]byte(cidr))
+	return ifaces[h.Sum32()%uint32(len(ifaces))]
+}
+
+// MultiIfaceIPHandler spreads IPs across links from a comma separated iface
+// list and passes requests to Handler
+type MultiIfaceIPHandler struct {
+	Handler IPHandler
+}
+
+func (m MultiIfaceIPHandler) Add(iface, cidr string) error {
+	return m.Handler.Add(m.selectIface(iface, cidr), cidr)
+}
+
+func (m MultiIfaceIPHandler) Del(iface, cidr string) error {
+	return m.Handler.Del(m.selectIface(iface, cidr), cidr)
+}
+
+func (m MultiIfaceIPHandler) selectIface(iface, cidr string) string {
+	ifaces := SplitIfaces(iface)
+	if len(ifaces) < 2 {
+		return iface
+	}
+	selected := IfaceForCIDR(ifaces, cidr)
+	glog.V(5).Infof("Link %v was selected for %v", selected, cidr)
+	return selected
+}
+
+// Limiter blocks until an operation is allowed, it is satisfied by
+// client-go flowcontrol.RateLimiter
+type Limiter interface {
+	Accept()
+}
+
+// RateLimitedIPHandler paces additions of IPs, e.g. when a node reclaims
+// many IPs at once. Removals are not limited
+type RateLimitedIPHandler struct {
+	Handler IPHandler
+	Limiter Limiter
+}
+
+func (r RateLimitedIPHandler) Add(iface, cidr string) error {
+	r.Limiter.Accept()
+	return r.Handler.Add(iface, cidr)
+}
+
+func (r RateLimitedIPHandler) Del(iface, cidr string) error {
+	return r.Handler.Del(iface, cidr)
+}
+
+// LinkCheckIPHandler refuses to add IPs to links that are down or have
+// unexpected MTU. Removals are not checked
+type LinkCheckIPHandler struct {
+	Handler   IPHandler
+	RequireUp bool
+	// ExpectMTU is not checked if 0
+	ExpectMTU int
+}
+
+func (l LinkCheckIPHandler) Add(iface, cidr string) error {
+	link, err := linkByName(iface)
+	if err != nil {
+		return err
+	}
+	attrs := link.Attrs()
+	if l.RequireUp && attrs.Flags&net.FlagUp == 0 {
+		return fmt.Errorf("Link %v is down, IP %v will not be assigned", iface, cidr)
+	}
+	if l.ExpectMTU != 0 && attrs.MTU != l.ExpectMTU {
+		return fmt.Errorf("Link %v has MTU %d instead of %d, IP %v will not be assigned",
+			iface, attrs.MTU, l.ExpectMTU, cidr)
+	}
+	return l.Handler.Add(iface, cidr)
+}
+
+func (l LinkCheckIPHandler) Del(iface, cidr string) error {
+	return l.Handler.Del(iface, cidr)
+}
+
+// LinkMissingError is returned when IP is assigned to a link that does not
+// exist, e.g. after hot removal of a NIC
+type LinkMissingError struct {
+	Link string
+	Err  error
+}
+
+func (e *LinkMissingError) Error() string {
+	return fmt.Sprintf("link %s is missing: %v", e.Link, e.Err)
+}
+
+// IsLinkMissing returns true if err is LinkMissingError
+func IsLinkMissing(err error) bool {
+	_, ok := err.(*LinkMissingError)
+	return ok
+}
+
+// LinkWaitIPHandler fails assignments with LinkMissingError while a link is
+// missing, so that they are retried by a caller and resume once the link
+// appears again. Removals from a missing link are skipped
+type LinkWaitIPHandler struct {
+	Handler IPHandler
+	// HardwareAddr selects a link when there is no link with a given name,
+	// so IPs follow a renamed link
+	HardwareAddr net.HardwareAddr
+}
+
+func (l LinkWaitIPHandler) Add(iface, cidr string) error {
+	resolved, err := l.resolve(iface)
+	if err != nil {
+		return &LinkMissingError{Link: iface, Err: err}
+	}
+	return l.Handler.Add(resolved, cidr)
+}
+
+func (l LinkWaitIPHandler) Del(iface, cidr string) error {
+	resolved, err := l.resolve(iface)
+	if err != nil {
+		glog.V(3).Infof("Link %v is missing, there is nothing to remove for %v: %v", iface, cidr, err)
+		return nil
+	}
+	return l.Handler.Del(resolved, cidr)
+}
+
+// resolve returns name of a link with a given name or hardware address
+func (l LinkWaitIPHandler) resolve(iface string) (string, error) {
+	_, err := linkByName(iface)
+	if err == nil || len(l.HardwareAddr) == 0 {
+		return iface, err
+	}
+	links, listErr := linkList()
+	if listErr != nil {
+		return "", listErr
+	}
+	for _, link := range links {
+		if link.Attrs().HardwareAddr.String() == l.HardwareAddr.String() {
+			return link.Attrs().Name, nil
+		}
+	}
+	return "", err
+}
+
+// HookIPHandler runs external commands before and after IP changes done by
+// a wrapped handler. Commands get action (add or del), cidr and iface as
+// arguments and as EXTERNALIP_ACTION, EXTERNALIP_CIDR and EXTERNALIP_IFACE
+// environment variables. Failed pre hook aborts the change, failed post hook
+// is only logged. Hooks run when IP is added or removed for the first time
+// since start, repeated calls for the same state are passed without hooks
+type HookIPHandler struct {
+	Handler  IPHandler
+	PreHook  string
+	PostHook string
+	// Timeout limits execution of every hook, 0 means no limit
+	Timeout time.Duration
+
+	lock     sync.Mutex
+	assigned map[string]bool
+}
+
+func (h *HookIPHandler) Add(iface, cidr string) error {
+	return h.change("add", iface, cidr, h.Handler.Add)
+}
+
+func (h *HookIPHandler) Del(iface, cidr string) error {
+	return h.change("del", iface, cidr, h.Handler.Del)
+}
+
+func (h *HookIPHandler) change(action, iface, cidr string, apply func(string, string) error) error {
+	h.lock.Lock()
+	if h.assigned == nil {
+		h.assigned = map[string]bool{}
+	}
+	assigned := h.assigned[cidr]
+	h.lock.Unlock()
+	if assigned == (action == "add") {
+		return apply(iface, cidr)
+	}
+	if h.PreHook != "" {
+		if err := runHook(h.PreHook, h.Timeout, action, iface, cidr); err != nil {
+			return fmt.Errorf("Pre hook for %v of %v failed: %v", action, cidr, err)
+		}
+	}
+	if err := apply(iface, cidr); err != nil {
+		return err
+	}
+	h.lock.Lock()
+	h.assigned[cidr] = action == "add"
+	h.lock.Unlock()
+	if h.PostHook != "" {
+		if err := runHook(h.PostHook, h.Timeout, action, iface, cidr); err != nil {
+			glog.Errorf("Post hook for %v of %v failed: %v", action, cidr, err)
+		}
+	}
+	return nil
+}
+
+func runHook(path string, timeout time.Duration, action, iface, cidr string) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, path, action, cidr, iface)
+	cmd.Env = append(os.Environ(),
+		"EXTERNALIP_ACTION="+action,
+		"EXTERNALIP_CIDR="+cidr,
+		"EXTERNALIP_IFACE="+iface,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	glog.V(4).Infof("Hook %v %v %v %v: %s", path, action, cidr, iface, out)
+	return nil
+}
+
+// DryRunIPHandler only logs actions that would be done by LinuxIPHandler
+type DryRunIPHandler struct{}
+
+func (d DryRunIPHandler) Add(iface, cidr string) error {
+	glog.Infof("dry-run: action=add iface=%s cidr=%s", iface, cidr)
+	return nil
+}
+
+func (d DryRunIPHandler) Del(iface, cidr string) error {
+	glog.Infof("dry-run: action=del iface=%s cidr=%s", iface, cidr)
+	return nil
+}
+
 type AddCIDR struct {
 	Cidr string
 }
@@ -144,6 +850,52 @@ type DelCIDR struct {
 	Cidr string
 }
 
+// ValidateMask checks that mask is a correct prefix length for IPv4 or IPv6
+func ValidateMask(mask string) error {
+	m, err := strconv.Atoi(mask)
+	if err != nil || m < 0 || m > 8*net.IPv6len {
+		return fmt.Errorf("Incorrect mask '%v', it should be an integer between 0 and %d", mask, 8*net.IPv6len)
+	}
+	return nil
+}
+
+// ParseExternalIP splits external IP of a service into address and mask.
+// IP may carry its own prefix length (e.g. 10.0.0.1/24), otherwise
+// defaultMask is used
+func ParseExternalIP(ip, defaultMask string) (addr, mask string, err error) {
+	addr, mask = ip, defaultMask
+	if parts := strings.SplitN(ip, "/", 2); len(parts) == 2 {
+		addr, mask = parts[0], parts[1]
+	}
+	parsed := net.ParseIP(addr)
+	if parsed == nil {
+		return "", "", fmt.Errorf("Incorrect IP address '%v'", addr)
+	}
+	bits := 8 * net.IPv6len
+	if parsed.To4() != nil {
+		bits = 8 * net.IPv4len
+	}
+	m, err := strconv.Atoi(mask)
+	if err != nil || m < 0 || m > bits {
+		return "", "", fmt.Errorf("Incorrect mask '%v' for IP '%v', it should be an integer between 0 and %d",
+			mask, addr, bits)
+	}
+	return addr, mask, nil
+}
+
+// ParseNetworks parses a list of CIDRs, e.g. ranges of IPs given by flags
+func ParseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
 func IPIncrement(ip net.IP) {
 	for j := len(ip) - 1; j >= 0; j-- {
 		ip[j]++
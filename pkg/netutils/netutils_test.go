@@ -0,0 +1,633 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package netutils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/vishvananda/netlink"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+type fakeIpHandler struct {
+	mock.Mock
+}
+
+func (f *fakeIpHandler) Add(iface, cidr string) error {
+	args := f.Called(iface, cidr)
+	return args.Error(0)
+}
+
+func (f *fakeIpHandler) Del(iface, cidr string) error {
+	args := f.Called(iface, cidr)
+	return args.Error(0)
+}
+
+func fakeLinkAddrs() ([]LinkAddr, error) {
+	addrs := []LinkAddr{}
+	for _, la := range []struct{ link, cidr string }{
+		{"lo", "127.0.0.1/8"},
+		{"eth0", "10.10.0.2/24"},
+		{"eth1", "192.168.1.2/24"},
+	} {
+		ip, network, _ := net.ParseCIDR(la.cidr)
+		network.IP = ip
+		addrs = append(addrs, LinkAddr{Link: la.link, Network: network})
+	}
+	return addrs, nil
+}
+
+func TestLinkForIP(t *testing.T) {
+	addrs, _ := fakeLinkAddrs()
+	assert.Equal(t, "eth1", LinkForIP(net.ParseIP("192.168.1.10"), addrs, "eth0"))
+	assert.Equal(t, "eth0", LinkForIP(net.ParseIP("10.10.0.20"), addrs, "eth1"))
+	assert.Equal(t, "eth0", LinkForIP(net.ParseIP("172.16.0.1"), addrs, "eth0"),
+		"Fallback link expected for an IP without matching subnet")
+	assert.Equal(t, "eth0", LinkForIP(net.ParseIP("127.0.0.5"), addrs, "eth0"),
+		"Loopback link should never be selected")
+}
+
+func TestAutoIfaceIPHandler(t *testing.T) {
+	fake := &fakeIpHandler{}
+	handler := AutoIfaceIPHandler{Handler: fake, ListAddrs: fakeLinkAddrs}
+	fake.On("Add", "eth1", "192.168.1.10/32").Return(nil)
+	fake.On("Del", "eth0", "172.16.0.1/32").Return(nil)
+	assert.NoError(t, handler.Add("eth0", "192.168.1.10/32"))
+	assert.NoError(t, handler.Del("eth0", "172.16.0.1/32"))
+	fake.AssertExpectations(t)
+}
+
+func TestMultiIfaceIPHandler(t *testing.T) {
+	ifaces := SplitIfaces("eth0, eth1,")
+	assert.Equal(t, []string{"eth0", "eth1"}, ifaces)
+
+	counts := map[string]int{}
+	for i := 0; i < 200; i++ {
+		cidr := fmt.Sprintf("10.10.%d.%d/32", i/100, i%100)
+		selected := IfaceForCIDR(ifaces, cidr)
+		assert.Equal(t, selected, IfaceForCIDR(ifaces, cidr), "Selection should be stable")
+		counts[selected]++
+	}
+	assert.Len(t, counts, 2)
+	for iface, count := range counts {
+		assert.True(t, count > 70, "Link %v got only %d of 200 IPs", iface, count)
+	}
+
+	fake := &fakeIpHandler{}
+	handler := MultiIfaceIPHandler{Handler: fake}
+	selected := IfaceForCIDR(ifaces, "10.10.0.2/32")
+	fake.On("Add", selected, "10.10.0.2/32").Return(nil)
+	fake.On("Del", selected, "10.10.0.2/32").Return(nil)
+	fake.On("Del", "eth1", "10.10.0.3/32").Return(nil)
+	assert.NoError(t, handler.Add("eth0,eth1", "10.10.0.2/32"))
+	assert.NoError(t, handler.Del("eth0,eth1", "10.10.0.2/32"))
+	assert.NoError(t, handler.Del("eth1", "10.10.0.3/32"), "Single link should be used as is")
+	fake.AssertExpectations(t)
+}
+
+func TestParseExternalIP(t *testing.T) {
+	for _, tc := range []struct {
+		ip, mask, addr, expectedMask string
+		err                          bool
+	}{
+		{ip: "10.0.0.1", mask: "32", addr: "10.0.0.1", expectedMask: "32"},
+		{ip: "10.0.0.1/24", mask: "32", addr: "10.0.0.1", expectedMask: "24"},
+		{ip: "2001:db8::1", mask: "64", addr: "2001:db8::1", expectedMask: "64"},
+		{ip: "2001:db8::1/128", mask: "32", addr: "2001:db8::1", expectedMask: "128"},
+		{ip: "2001:db8::1", mask: "129", err: true},
+		{ip: "10.0.0.1", mask: "64", err: true},
+		{ip: "10.0.0.1", mask: "abc", err: true},
+		{ip: "10.0.0.1", mask: "33", err: true},
+		{ip: "10.0.0.1/x", mask: "32", err: true},
+		{ip: "10.0.0", mask: "32", err: true},
+		{ip: "abc", mask: "32", err: true},
+	} {
+		addr, mask, err := ParseExternalIP(tc.ip, tc.mask)
+		if tc.err {
+			assert.Error(t, err, "Error expected for %v with mask %v", tc.ip, tc.mask)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, tc.addr, addr)
+		assert.Equal(t, tc.expectedMask, mask)
+	}
+}
+
+func TestValidateMask(t *testing.T) {
+	assert.NoError(t, ValidateMask("32"))
+	assert.NoError(t, ValidateMask("0"))
+	assert.Error(t, ValidateMask("abc"))
+	assert.Error(t, ValidateMask("-1"))
+}
+
+func TestLinuxIPHandlerAnnouncesNewAddress(t *testing.T) {
+	defer func(a func(string, string, AddrOptions) (*net.IPNet, error), n func(string, *net.IPNet, int) error) {
+		addIP, announce = a, n
+	}(addIP, announce)
+	assigned := map[string]bool{}
+	addIP = func(iface, cidr string, opts AddrOptions) (*net.IPNet, error) {
+		if assigned[cidr] {
+			return nil, nil
+		}
+		assigned[cidr] = true
+		ip, network, err := net.ParseCIDR(cidr)
+		network.IP = ip
+		return network, err
+	}
+	type call struct {
+		iface, cidr string
+		count       int
+	}
+	calls := []call{}
+	announce = func(iface string, addr *net.IPNet, count int) error {
+		calls = append(calls, call{iface, addr.String(), count})
+		return nil
+	}
+
+	handler := LinuxIPHandler{GARPCount: 3}
+	assert.NoError(t, handler.Add("eth0", "10.10.0.2/24"))
+	assert.NoError(t, handler.Add("eth0", "fd00::2/64"))
+	assert.NoError(t, handler.Add("eth0", "10.10.0.2/24"))
+	assert.NoError(t, handler.Add("lo", "10.10.0.3/32"))
+	assert.Equal(t, []call{{"eth0", "10.10.0.2/24", 3}, {"eth0", "fd00::2/64", 3}}, calls,
+		"Only new addresses on non loopback links should be announced")
+}
+
+func TestAddIPIfMissing(t *testing.T) {
+	defer func(l func(string) (netlink.Link, error), a func(netlink.Link, *netlink.Addr) error, ls func() ([]LinkAddr, error)) {
+		linkByName, addrAdd, listAddrs = l, a, ls
+	}(linkByName, addrAdd, listAddrs)
+	linkByName = func(name string) (netlink.Link, error) {
+		return &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}}, nil
+	}
+	added := []string{}
+	addrAdd = func(link netlink.Link, addr *netlink.Addr) error {
+		added = append(added, addr.IPNet.String())
+		return nil
+	}
+	listAddrs = func() ([]LinkAddr, error) {
+		present := []LinkAddr{}
+		for link, cidr := range map[string]string{"eth0": "10.10.0.2/24", "eth1": "10.10.0.3/24"} {
+			ip, network, _ := net.ParseCIDR(cidr)
+			network.IP = ip
+			present = append(present, LinkAddr{Link: link, Network: network})
+		}
+		return present, nil
+	}
+
+	network, err := addIPIfMissing("eth0", "10.10.0.2/24", AddrOptions{})
+	assert.NoError(t, err)
+	assert.Nil(t, network, "Present address should not be reported as new")
+	assert.Empty(t, added, "Present address should not be added")
+
+	_, err = addIPIfMissing("eth0", "10.10.0.3/24", AddrOptions{})
+	assert.Error(t, err, "Address present on other link should not be added")
+	assert.Empty(t, added)
+
+	network, err = addIPIfMissing("eth0", "10.10.0.4/24", AddrOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "10.10.0.4/24", network.String())
+	assert.Equal(t, []string{"10.10.0.4/24"}, added)
+
+	addrAdd = func(link netlink.Link, addr *netlink.Addr) error {
+		return syscall.EEXIST
+	}
+	network, err = addIPIfMissing("eth0", "10.10.0.5/24", AddrOptions{})
+	assert.NoError(t, err, "Address added concurrently should not be an error")
+	assert.Nil(t, network)
+}
+
+func TestAddIPIfMissingOptions(t *testing.T) {
+	defer func(l func(string) (netlink.Link, error), a func(netlink.Link, *netlink.Addr) error, ls func() ([]LinkAddr, error)) {
+		linkByName, addrAdd, listAddrs = l, a, ls
+	}(linkByName, addrAdd, listAddrs)
+	linkByName = func(name string) (netlink.Link, error) {
+		return &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}}, nil
+	}
+	listAddrs = func() ([]LinkAddr, error) {
+		return nil, nil
+	}
+	added := []*netlink.Addr{}
+	addrAdd = func(link netlink.Link, addr *netlink.Addr) error {
+		added = append(added, addr)
+		return nil
+	}
+
+	_, err := addIPIfMissing("eth0", "10.10.0.2/32", AddrOptions{})
+	assert.NoError(t, err)
+	scope, err := ParseAddrScope("host")
+	assert.NoError(t, err)
+	_, err = addIPIfMissing("eth0", "10.10.0.3/32", AddrOptions{Scope: scope, NoPrefixRoute: true})
+	assert.NoError(t, err)
+	if assert.Len(t, added, 2) {
+		assert.Equal(t, int(netlink.SCOPE_UNIVERSE), added[0].Scope)
+		assert.Equal(t, 0, added[0].Flags, "Address flags should not be set by default")
+		assert.Equal(t, int(netlink.SCOPE_HOST), added[1].Scope)
+		assert.Equal(t, ifaNoPrefixRoute, added[1].Flags&ifaNoPrefixRoute)
+	}
+
+	_, err = ParseAddrScope("galaxy")
+	assert.Error(t, err)
+}
+
+func TestAddIPIfMissingPeer(t *testing.T) {
+	defer func(l func(string) (netlink.Link, error), a func(netlink.Link, *netlink.Addr) error, ls func() ([]LinkAddr, error)) {
+		linkByName, addrAdd, listAddrs = l, a, ls
+	}(linkByName, addrAdd, listAddrs)
+	linkByName = func(name string) (netlink.Link, error) {
+		return &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}}, nil
+	}
+	listAddrs = func() ([]LinkAddr, error) {
+		return nil, nil
+	}
+	var added *netlink.Addr
+	addrAdd = func(link netlink.Link, addr *netlink.Addr) error {
+		added = addr
+		return nil
+	}
+
+	for _, tc := range []struct {
+		cidr, peer string
+	}{
+		{"10.10.0.2/31", "10.10.0.3/31"},
+		{"10.10.0.3/31", "10.10.0.2/31"},
+		{"fd00::4/127", "fd00::5/127"},
+		{"10.10.0.2/32", ""},
+		{"10.10.0.2/24", ""},
+	} {
+		_, err := addIPIfMissing("eth0", tc.cidr, AddrOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, tc.cidr, added.IPNet.String())
+		if tc.peer == "" {
+			assert.Nil(t, added.Peer, "Peer should not be set for %v", tc.cidr)
+		} else if assert.NotNil(t, added.Peer, "Peer should be set for %v", tc.cidr) {
+			assert.Equal(t, tc.peer, added.Peer.String())
+		}
+	}
+}
+
+func TestRouteIPHandler(t *testing.T) {
+	defer func(l func(string) (netlink.Link, error), a, d func(*netlink.Route) error, ip func(string, string, AddrOptions) (*net.IPNet, error)) {
+		linkByName, routeAdd, routeDel, addIP = l, a, d, ip
+	}(linkByName, routeAdd, routeDel, addIP)
+	linkByName = func(name string) (netlink.Link, error) {
+		return &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name, Index: 7}}, nil
+	}
+	added, deleted := []*netlink.Route{}, []*netlink.Route{}
+	routeAdd = func(r *netlink.Route) error {
+		added = append(added, r)
+		return nil
+	}
+	routeDel = func(r *netlink.Route) error {
+		deleted = append(deleted, r)
+		return syscall.ESRCH
+	}
+	addIP = func(iface, cidr string, opts AddrOptions) (*net.IPNet, error) {
+		t.Errorf("Address %v should not be assigned in route mode", cidr)
+		return nil, nil
+	}
+
+	handler := RouteIPHandler{}
+	assert.NoError(t, handler.Add("lo", "10.10.0.2/24"))
+	assert.NoError(t, handler.Add("lo", "fd00::2/64"))
+	if assert.Len(t, added, 2) {
+		assert.Equal(t, 7, added[0].LinkIndex)
+		assert.Equal(t, "10.10.0.2/32", added[0].Dst.String(), "Host route expected regardless of mask")
+		assert.Equal(t, syscall.RTN_LOCAL, added[0].Type)
+		assert.Equal(t, "fd00::2/128", added[1].Dst.String())
+		assert.Nil(t, added[0].Src, "Preferred source should not be set by default")
+	}
+	assert.NoError(t, handler.Del("lo", "10.10.0.2/24"), "Missing route should not be an error")
+	assert.Len(t, deleted, 1)
+	assert.Equal(t, syscall.RT_TABLE_LOCAL, deleted[0].Table, "Local table should be used by default")
+
+	handler = RouteIPHandler{Table: 100}
+	assert.NoError(t, handler.Add("lo", "10.10.0.3/32"))
+	assert.NoError(t, handler.Del("lo", "10.10.0.3/32"))
+	assert.Equal(t, 100, added[2].Table, "Route should be added to configured table")
+	assert.Equal(t, 100, deleted[1].Table, "Route should be removed only from configured table")
+
+	handler = RouteIPHandler{SrcVIP: true}
+	assert.NoError(t, handler.Add("lo", "10.10.0.4/24"))
+	assert.NoError(t, handler.Add("lo", "fd00::4/64"))
+	assert.Equal(t, "10.10.0.4", added[3].Src.String(), "External IP should be preferred source of its route")
+	assert.Equal(t, "fd00::4", added[4].Src.String())
+	assert.NoError(t, handler.Del("lo", "10.10.0.4/24"))
+	assert.Nil(t, deleted[2].Src, "Route should be removed regardless of its preferred source")
+}
+
+func TestListLocalRoutes(t *testing.T) {
+	defer func(i func(int) (netlink.Link, error), l func(int, *netlink.Route, uint64) ([]netlink.Route, error)) {
+		linkByIndex, routeList = i, l
+	}(linkByIndex, routeList)
+	linkByIndex = func(index int) (netlink.Link, error) {
+		return &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: fmt.Sprintf("link%d", index), Index: index}}, nil
+	}
+	var filter *netlink.Route
+	routeList = func(family int, f *netlink.Route, mask uint64) ([]netlink.Route, error) {
+		filter = f
+		_, vip, _ := net.ParseCIDR("10.10.0.2/32")
+		_, addr, _ := net.ParseCIDR("192.168.0.10/32")
+		return []netlink.Route{
+			{LinkIndex: 7, Dst: vip, Protocol: syscall.RTPROT_BOOT},
+			{LinkIndex: 2, Dst: addr, Protocol: syscall.RTPROT_KERNEL},
+		}, nil
+	}
+
+	routes, err := ListLocalRoutes(0)
+	assert.NoError(t, err)
+	assert.Equal(t, syscall.RT_TABLE_LOCAL, filter.Table, "Local table should be listed by default")
+	assert.Equal(t, syscall.RTN_LOCAL, filter.Type)
+	if assert.Len(t, routes, 1, "Routes of link addresses should be skipped") {
+		assert.Equal(t, "link7", routes[0].Link)
+		assert.Equal(t, "10.10.0.2/32", routes[0].Network.String())
+	}
+
+	_, err = ListLocalRoutes(100)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, filter.Table, "Only configured table should be listed")
+}
+
+func TestSubnetAssignedAsBlock(t *testing.T) {
+	defer func(l func(string) (netlink.Link, error), a, d func(*netlink.Route) error, ip func(string, string, AddrOptions) (*net.IPNet, error)) {
+		linkByName, routeAdd, routeDel, addIP = l, a, d, ip
+	}(linkByName, routeAdd, routeDel, addIP)
+	linkByName = func(name string) (netlink.Link, error) {
+		return &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name, Index: 7}}, nil
+	}
+	added, deleted := []*netlink.Route{}, []*netlink.Route{}
+	routeAdd = func(r *netlink.Route) error {
+		added = append(added, r)
+		return nil
+	}
+	routeDel = func(r *netlink.Route) error {
+		deleted = append(deleted, r)
+		return nil
+	}
+	addIP = func(iface, cidr string, opts AddrOptions) (*net.IPNet, error) {
+		t.Errorf("Subnet %v should not be assigned as an address", cidr)
+		return nil, nil
+	}
+
+	assert.True(t, IsSubnet("10.10.0.0/28"))
+	assert.False(t, IsSubnet("10.10.0.2/28"))
+	assert.False(t, IsSubnet("10.10.0.0/32"))
+	assert.Equal(t, 16, SubnetSize("10.10.0.0/28"))
+	assert.Equal(t, 1, SubnetSize("10.10.0.2/24"))
+	assert.Equal(t, maxSubnetSize, SubnetSize("fd00::/64"))
+
+	handler := LinuxIPHandler{}
+	assert.NoError(t, handler.Add("eth0", "10.10.0.0/28"))
+	assert.NoError(t, handler.Del("eth0", "10.10.0.0/28"))
+	if assert.Len(t, added, 1) {
+		assert.Equal(t, "10.10.0.0/28", added[0].Dst.String(), "Local route should cover whole subnet")
+		assert.Equal(t, syscall.RTN_LOCAL, added[0].Type)
+	}
+	if assert.Len(t, deleted, 1) {
+		assert.Equal(t, "10.10.0.0/28", deleted[0].Dst.String())
+	}
+
+	assert.NoError(t, RouteIPHandler{SrcVIP: true}.Add("lo", "10.10.0.16/28"))
+	assert.Nil(t, added[1].Src, "Subnet route should not have preferred source")
+}
+
+func TestCheckNetAdmin(t *testing.T) {
+	defer func(l func(string) (netlink.Link, error), m func(netlink.Link, int) error) {
+		linkByName, linkSetMTU = l, m
+	}(linkByName, linkSetMTU)
+	linkByName = func(name string) (netlink.Link, error) {
+		return &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: name, MTU: 65536}}, nil
+	}
+	linkSetMTU = func(link netlink.Link, mtu int) error {
+		assert.Equal(t, "lo", link.Attrs().Name)
+		assert.Equal(t, 65536, mtu, "MTU should not be changed")
+		return nil
+	}
+	assert.NoError(t, CheckNetAdmin())
+
+	linkSetMTU = func(link netlink.Link, mtu int) error {
+		return syscall.EPERM
+	}
+	err := CheckNetAdmin()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "missing CAP_NET_ADMIN")
+	}
+
+	linkSetMTU = func(link netlink.Link, mtu int) error {
+		return syscall.ENODEV
+	}
+	err = CheckNetAdmin()
+	if assert.Error(t, err) {
+		assert.NotContains(t, err.Error(), "CAP_NET_ADMIN", "Only permission errors should be reported as missing capability")
+	}
+}
+
+func TestEnsureDummyLink(t *testing.T) {
+	defer func(l func(string) (netlink.Link, error), a, d, u func(netlink.Link) error) {
+		linkByName, linkAdd, linkDel, linkSetUp = l, a, d, u
+	}(linkByName, linkAdd, linkDel, linkSetUp)
+	links := map[string]netlink.Link{}
+	linkByName = func(name string) (netlink.Link, error) {
+		if link, exists := links[name]; exists {
+			return link, nil
+		}
+		return nil, fmt.Errorf("Link not found")
+	}
+	linkAdd = func(link netlink.Link) error {
+		assert.Equal(t, "dummy", link.Type())
+		links[link.Attrs().Name] = link
+		return nil
+	}
+	up := []string{}
+	linkSetUp = func(link netlink.Link) error {
+		up = append(up, link.Attrs().Name)
+		return nil
+	}
+	linkDel = func(link netlink.Link) error {
+		delete(links, link.Attrs().Name)
+		return nil
+	}
+
+	created, err := EnsureDummyLink("extvip0")
+	assert.NoError(t, err)
+	assert.True(t, created)
+	created, err = EnsureDummyLink("extvip0")
+	assert.NoError(t, err)
+	assert.False(t, created, "Existing link should not be created again")
+	assert.Len(t, links, 1)
+	assert.Equal(t, []string{"extvip0", "extvip0"}, up)
+
+	assert.NoError(t, RemoveLink("extvip0"))
+	assert.Empty(t, links)
+}
+
+func TestLinkCheckIPHandler(t *testing.T) {
+	defer func(l func(string) (netlink.Link, error)) {
+		linkByName = l
+	}(linkByName)
+	linkByName = func(name string) (netlink.Link, error) {
+		attrs := netlink.LinkAttrs{Name: name, MTU: 1500}
+		if name != "down0" {
+			attrs.Flags = net.FlagUp
+		}
+		return &netlink.Dummy{LinkAttrs: attrs}, nil
+	}
+	fiphandler := &fakeIpHandler{}
+	fiphandler.On("Add", "eth0", "10.10.0.2/32").Return(nil)
+	fiphandler.On("Del", "down0", "10.10.0.3/32").Return(nil)
+
+	handler := LinkCheckIPHandler{Handler: fiphandler, RequireUp: true}
+	assert.NoError(t, handler.Add("eth0", "10.10.0.2/32"))
+	assert.Error(t, handler.Add("down0", "10.10.0.3/32"), "IP should not be assigned to a link that is down")
+	assert.NoError(t, handler.Del("down0", "10.10.0.3/32"), "IP should be removed from a link that is down")
+
+	handler.ExpectMTU = 9000
+	assert.Error(t, handler.Add("eth0", "10.10.0.2/32"), "IP should not be assigned to a link with unexpected MTU")
+	handler.ExpectMTU = 1500
+	assert.NoError(t, handler.Add("eth0", "10.10.0.2/32"))
+
+	handler = LinkCheckIPHandler{Handler: fiphandler}
+	fiphandler.On("Add", "down0", "10.10.0.3/32").Return(nil)
+	assert.NoError(t, handler.Add("down0", "10.10.0.3/32"), "Link state should not be checked if not required")
+	fiphandler.AssertExpectations(t)
+}
+
+func TestLinkWaitIPHandler(t *testing.T) {
+	defer func(l func(string) (netlink.Link, error), ls func() ([]netlink.Link, error)) {
+		linkByName, linkList = l, ls
+	}(linkByName, linkList)
+	mac, _ := net.ParseMAC("02:42:ac:11:00:02")
+	links := map[string]netlink.Link{}
+	lookups := 0
+	linkByName = func(name string) (netlink.Link, error) {
+		lookups++
+		if lookups == 3 {
+			links["eth0"] = &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth0", HardwareAddr: mac}}
+		}
+		if link, exists := links[name]; exists {
+			return link, nil
+		}
+		return nil, fmt.Errorf("Link not found")
+	}
+	linkList = func() ([]netlink.Link, error) {
+		result := []netlink.Link{}
+		for _, link := range links {
+			result = append(result, link)
+		}
+		return result, nil
+	}
+	fiphandler := &fakeIpHandler{}
+	fiphandler.On("Add", "eth0", "10.10.0.2/32").Return(nil)
+	handler := LinkWaitIPHandler{Handler: fiphandler}
+
+	assert.NoError(t, handler.Del("eth0", "10.10.0.2/32"), "Removal from missing link should be skipped")
+	err := handler.Add("eth0", "10.10.0.2/32")
+	assert.True(t, IsLinkMissing(err), "Assignment to missing link should fail, got %v", err)
+	assert.NoError(t, handler.Add("eth0", "10.10.0.2/32"), "Assignment should resume once link appears")
+	assert.Equal(t, 3, lookups)
+
+	delete(links, "eth0")
+	links["eth1"] = &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "eth1", HardwareAddr: mac}}
+	handler.HardwareAddr = mac
+	fiphandler.On("Add", "eth1", "10.10.0.3/32").Return(nil)
+	assert.NoError(t, handler.Add("eth0", "10.10.0.3/32"))
+	assert.Equal(t, "eth1", fiphandler.Calls[1].Arguments[0], "Renamed link should be found by hardware address")
+}
+
+func TestRateLimitedIPHandler(t *testing.T) {
+	fiphandler := &fakeIpHandler{}
+	fiphandler.On("Add", "eth0", mock.Anything).Return(nil)
+	fiphandler.On("Del", "eth0", mock.Anything).Return(nil)
+	handler := RateLimitedIPHandler{
+		Handler: fiphandler,
+		Limiter: flowcontrol.NewTokenBucketRateLimiter(2, 1),
+	}
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, handler.Del("eth0", fmt.Sprintf("10.10.0.%d/32", i)))
+	}
+	assert.True(t, time.Since(start) < 500*time.Millisecond, "Removals should not be limited")
+
+	start = time.Now()
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, handler.Add("eth0", fmt.Sprintf("10.10.0.%d/32", i)))
+	}
+	assert.True(t, time.Since(start) >= 2*time.Second,
+		"6 additions with 2 per second should take at least 2 seconds, took %v", time.Since(start))
+	assert.Len(t, fiphandler.Calls, 12)
+}
+
+func writeHook(t *testing.T, dir, name, body string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHookIPHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	log := filepath.Join(dir, "log")
+	record := fmt.Sprintf("echo \"$0 $EXTERNALIP_ACTION $EXTERNALIP_CIDR $EXTERNALIP_IFACE $@\" >> %s\n", log)
+	pre := writeHook(t, dir, "pre", record)
+	post := writeHook(t, dir, "post", record+"exit 3\n")
+
+	fiphandler := &fakeIpHandler{}
+	fiphandler.On("Add", "eth0", "10.10.0.2/32").Return(nil)
+	fiphandler.On("Del", "eth0", "10.10.0.2/32").Return(nil)
+	handler := &HookIPHandler{Handler: fiphandler, PreHook: pre, PostHook: post, Timeout: 5 * time.Second}
+	assert.NoError(t, handler.Add("eth0", "10.10.0.2/32"), "Failed post hook should not fail assignment")
+	assert.NoError(t, handler.Add("eth0", "10.10.0.2/32"))
+	assert.NoError(t, handler.Del("eth0", "10.10.0.2/32"))
+	fiphandler.AssertNumberOfCalls(t, "Add", 2)
+	fiphandler.AssertNumberOfCalls(t, "Del", 1)
+	out, err := ioutil.ReadFile(log)
+	assert.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf(
+		"%[1]s add 10.10.0.2/32 eth0 add 10.10.0.2/32 eth0\n"+
+			"%[2]s add 10.10.0.2/32 eth0 add 10.10.0.2/32 eth0\n"+
+			"%[1]s del 10.10.0.2/32 eth0 del 10.10.0.2/32 eth0\n"+
+			"%[2]s del 10.10.0.2/32 eth0 del 10.10.0.2/32 eth0\n", pre, post),
+		string(out), "Hooks should run once for every change")
+
+	failing := writeHook(t, dir, "failing", "echo record is locked\nexit 1\n")
+	fiphandler = &fakeIpHandler{}
+	handler = &HookIPHandler{Handler: fiphandler, PreHook: failing}
+	err = handler.Add("eth0", "10.10.0.3/32")
+	if assert.Error(t, err, "Failed pre hook should abort assignment") {
+		assert.Contains(t, err.Error(), "record is locked")
+	}
+	fiphandler.AssertNotCalled(t, "Add", "eth0", "10.10.0.3/32")
+
+	slow := writeHook(t, dir, "slow", "exec sleep 5\n")
+	handler = &HookIPHandler{Handler: fiphandler, PreHook: slow, Timeout: 100 * time.Millisecond}
+	start := time.Now()
+	assert.Error(t, handler.Add("eth0", "10.10.0.4/32"), "Hook should be killed after timeout")
+	assert.True(t, time.Since(start) < 2*time.Second)
+}
@@ -0,0 +1,52 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// Snapshot is a view of scheduler in-memory state used for debugging
+type Snapshot struct {
+	LiveNodes     []string       `json:"liveNodes"`
+	ClaimsPerNode map[string]int `json:"claimsPerNode"`
+	QueueLength   int            `json:"queueLength"`
+}
+
+// Snapshot returns copy of the current scheduler state
+func (s *ipClaimScheduler) Snapshot() Snapshot {
+	snapshot := Snapshot{LiveNodes: []string{}, ClaimsPerNode: map[string]int{}}
+	s.liveSync.Lock()
+	for name := range s.liveIpNodes {
+		snapshot.LiveNodes = append(snapshot.LiveNodes, name)
+	}
+	s.liveSync.Unlock()
+	sort.Strings(snapshot.LiveNodes)
+	snapshot.ClaimsPerNode = s.ClaimsPerNode()
+	if s.queue != nil {
+		snapshot.QueueLength = s.queue.Len()
+	}
+	return snapshot
+}
+
+// ServeHTTP writes scheduler snapshot as JSON
+func (s *ipClaimScheduler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.Snapshot()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/extensions"
+
+	"github.com/golang/glog"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// ExportedClaimsKey is a key of config map data that holds JSON object with
+// node names by claim CIDR
+const ExportedClaimsKey = "claims.json"
+
+// exportLoop mirrors claims ownership to ExportConfigMap on every tick if it
+// was changed since the last export, so api is not updated more often than
+// ticker fires
+func (s *ipClaimScheduler) exportLoop(stop chan struct{}, ticker <-chan time.Time) {
+	exported := ""
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker:
+			data, err := s.exportClaims(exported)
+			if err != nil {
+				glog.Errorf("Error exporting claims to config map %s/%s: %v", s.ExportNamespace, s.ExportConfigMap, err)
+				continue
+			}
+			exported = data
+		}
+	}
+}
+
+// exportClaims writes node names by claim CIDR to ExportConfigMap unless
+// they are equal to previously exported data, exported data is returned
+func (s *ipClaimScheduler) exportClaims(previous string) (string, error) {
+	// partial ownership of a new leader would overwrite complete one
+	if !s.HasSynced() {
+		glog.V(3).Infof("IP claims are not synced yet, skipping export")
+		return previous, nil
+	}
+	ownership := map[string]string{}
+	for _, obj := range s.claims().List() {
+		claim := obj.(*extensions.IpClaim)
+		if claim.Spec.NodeName != "" {
+			ownership[claim.Spec.Cidr] = claim.Spec.NodeName
+		}
+	}
+	// keys are sorted, so equal ownership gives equal data
+	raw, err := json.Marshal(ownership)
+	if err != nil {
+		return previous, err
+	}
+	data := string(raw)
+	if data == previous {
+		return previous, nil
+	}
+	if s.Observer {
+		glog.Infof("observer: action=update configmap=%s/%s data=%s", s.ExportNamespace, s.ExportConfigMap, data)
+		return data, nil
+	}
+	configMaps := s.Clientset.Core().ConfigMaps(s.ExportNamespace)
+	configMap, err := configMaps.Get(s.ExportConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		configMap = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: s.ExportConfigMap, Namespace: s.ExportNamespace},
+			Data:       map[string]string{ExportedClaimsKey: data},
+		}
+		_, err = configMaps.Create(configMap)
+	} else if err == nil {
+		if configMap.Data == nil {
+			configMap.Data = map[string]string{}
+		}
+		configMap.Data[ExportedClaimsKey] = data
+		_, err = configMaps.Update(configMap)
+	}
+	if err != nil {
+		return previous, err
+	}
+	glog.V(3).Infof("Exported %d claims to config map %s/%s", len(ownership), s.ExportNamespace, s.ExportConfigMap)
+	return data, nil
+}
@@ -15,37 +15,216 @@
 package scheduler
 
 import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
 	"github.com/Mirantis/k8s-externalipcontroller/pkg/extensions"
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/netutils"
 
 	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
-func (s *ipClaimScheduler) getFairNode(ipnodes []*extensions.IpNode) *extensions.IpNode {
+const (
+	DefaultNodeFilter = "fair"
+
+	// NodeWeightAnnotationKey can be set on IpNode to make fair node filter
+	// assign proportionally more (or less) claims to that node
+	NodeWeightAnnotationKey = "ipnode-weight"
+	defaultNodeWeight       = 1.0
+
+	// NodeDrainAnnotationKey set to "true" on IpNode moves all claims from
+	// that node and keeps new claims away until it is removed
+	NodeDrainAnnotationKey = "ipnode-drain"
+)
+
+// NodeDrained returns true if node is annotated for draining
+func NodeDrained(node *extensions.IpNode) bool {
+	return node.Metadata.Annotations[NodeDrainAnnotationKey] == "true"
+}
+
+// NodeWeight returns effective weight of a node used by fair node filter
+func NodeWeight(node *extensions.IpNode) float64 {
+	val, exists := node.Metadata.Annotations[NodeWeightAnnotationKey]
+	if !exists {
+		return defaultNodeWeight
+	}
+	weight, err := strconv.ParseFloat(val, 64)
+	if err != nil || weight <= 0 {
+		glog.Errorf("Incorrect weight '%v' for IP node '%v', default weight will be used",
+			val, node.Metadata.Name)
+		return defaultNodeWeight
+	}
+	return weight
+}
+
+// NodeWeights returns effective weights for a list of nodes keyed by node name
+func NodeWeights(ipnodes []*extensions.IpNode) map[string]float64 {
+	weights := make(map[string]float64, len(ipnodes))
+	for _, node := range ipnodes {
+		weights[node.Metadata.Name] = NodeWeight(node)
+	}
+	return weights
+}
+
+// NodeFilter selects a node for IP claim among live nodes
+type NodeFilter func([]*extensions.IpNode) *extensions.IpNode
+
+// ClaimCounter provides information about already scheduled claims
+type ClaimCounter interface {
+	ClaimsPerNode() map[string]int
+}
+
+// NodeFilterFactory creates NodeFilter for a scheduler
+type NodeFilterFactory func(ClaimCounter) NodeFilter
+
+var (
+	nodeFiltersLock sync.Mutex
+	nodeFilters     = map[string]NodeFilterFactory{}
+)
+
+func init() {
+	RegisterNodeFilter("fair", FairNodeFilter)
+	RegisterNodeFilter("first-alive", FirstAliveNodeFilter)
+}
+
+// RegisterNodeFilter makes node filter available by name, it panics if
+// a filter with the same name is already registered
+func RegisterNodeFilter(name string, factory NodeFilterFactory) {
+	nodeFiltersLock.Lock()
+	defer nodeFiltersLock.Unlock()
+	if _, exists := nodeFilters[name]; exists {
+		panic(fmt.Sprintf("Node filter %s is already registered", name))
+	}
+	nodeFilters[name] = factory
+}
+
+// NodeFilterNames returns sorted names of all registered node filters
+func NodeFilterNames() []string {
+	nodeFiltersLock.Lock()
+	defer nodeFiltersLock.Unlock()
+	names := make([]string, 0, len(nodeFilters))
+	for name := range nodeFilters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newNodeFilter(name string, claims ClaimCounter) (NodeFilter, error) {
+	nodeFiltersLock.Lock()
+	defer nodeFiltersLock.Unlock()
+	factory, exists := nodeFilters[name]
+	if !exists {
+		return nil, fmt.Errorf("Incorrect node filter is provided: %s", name)
+	}
+	return factory(claims), nil
+}
+
+// ClaimsPerNode returns number of scheduled claims for every node, subnet
+// claims are counted by their size if WeighSubnets is set
+func (s *ipClaimScheduler) ClaimsPerNode() map[string]int {
 	counter := make(map[string]int)
-	for _, key := range s.claimStore.ListKeys() {
-		obj, _, err := s.claimStore.GetByKey(key)
-		claim := obj.(*extensions.IpClaim)
+	store := s.claims()
+	if store == nil {
+		return counter
+	}
+	for _, key := range store.ListKeys() {
+		obj, exists, err := store.GetByKey(key)
 		if err != nil {
 			glog.Errorln(err)
 			continue
 		}
+		// claim could be deleted after its key was listed
+		if !exists {
+			continue
+		}
+		claim := obj.(*extensions.IpClaim)
 		if claim.Spec.NodeName == "" {
 			continue
 		}
-		counter[claim.Spec.NodeName]++
+		if s.WeighSubnets {
+			counter[claim.Spec.NodeName] += netutils.SubnetSize(claim.Spec.Cidr)
+		} else {
+			counter[claim.Spec.NodeName]++
+		}
+	}
+	return counter
+}
+
+// nodesBelowLimit returns nodes that can take need more claims without
+// exceeding max claims, max 0 means no limit
+func nodesBelowLimit(ipnodes []*extensions.IpNode, counter map[string]int, max, need int) []*extensions.IpNode {
+	if max <= 0 {
+		return ipnodes
+	}
+	result := make([]*extensions.IpNode, 0, len(ipnodes))
+	for _, node := range ipnodes {
+		if counter[node.Metadata.Name]+need <= max {
+			result = append(result, node)
+		}
+	}
+	return result
+}
+
+// nodesMatchingSelector returns nodes which labels match selector, empty
+// selector matches all nodes
+func nodesMatchingSelector(ipnodes []*extensions.IpNode, selector map[string]string) []*extensions.IpNode {
+	if len(selector) == 0 {
+		return ipnodes
 	}
-	var min *extensions.IpNode
-	minCount := -1
+	sel := labels.SelectorFromSet(labels.Set(selector))
+	result := make([]*extensions.IpNode, 0, len(ipnodes))
 	for _, node := range ipnodes {
-		count := counter[node.Metadata.Name]
-		if minCount == -1 || count < minCount {
-			minCount = count
-			min = node
+		if sel.Matches(labels.Set(node.Metadata.Labels)) {
+			result = append(result, node)
 		}
 	}
-	return min
+	return result
+}
+
+// nodeByName returns node with a given name or nil
+func nodeByName(ipnodes []*extensions.IpNode, name string) *extensions.IpNode {
+	for _, node := range ipnodes {
+		if node.Metadata.Name == name {
+			return node
+		}
+	}
+	return nil
+}
+
+// FairNodeFilter selects node with the smallest number of claims relative
+// to node weight
+func FairNodeFilter(claims ClaimCounter) NodeFilter {
+	return func(ipnodes []*extensions.IpNode) *extensions.IpNode {
+		counter := claims.ClaimsPerNode()
+		weights := NodeWeights(ipnodes)
+		var min *extensions.IpNode
+		minLoad := -1.0
+		for _, node := range ipnodes {
+			load := float64(counter[node.Metadata.Name]) / weights[node.Metadata.Name]
+			if minLoad == -1 || load < minLoad {
+				minLoad = load
+				min = node
+			}
+		}
+		return min
+	}
+}
+
+// FirstAliveNodeFilter always selects the first of live nodes
+func FirstAliveNodeFilter(_ ClaimCounter) NodeFilter {
+	return func(ipnodes []*extensions.IpNode) *extensions.IpNode {
+		return ipnodes[0]
+	}
+}
+
+func (s *ipClaimScheduler) getFairNode(ipnodes []*extensions.IpNode) *extensions.IpNode {
+	return FairNodeFilter(s)(ipnodes)
 }
 
 func (s *ipClaimScheduler) getFirstAliveNode(ipnodes []*extensions.IpNode) *extensions.IpNode {
-	return ipnodes[0]
+	return FirstAliveNodeFilter(s)(ipnodes)
 }
@@ -0,0 +1,77 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scheduler
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/extensions"
+)
+
+// ParsePins parses pins given as ip=node, ip may have a mask which is
+// ignored. It returns node names by IP
+func ParsePins(pins []string) (map[string]string, error) {
+	result := make(map[string]string, len(pins))
+	for _, pin := range pins {
+		parts := strings.SplitN(pin, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("Incorrect pin '%v', it should be ip=node", pin)
+		}
+		ip := pinnedIP(parts[0])
+		if ip == nil {
+			return nil, fmt.Errorf("Incorrect IP in pin '%v'", pin)
+		}
+		result[ip.String()] = strings.TrimSpace(parts[1])
+	}
+	return result, nil
+}
+
+// pinnedIP parses IP with or without a mask
+func pinnedIP(cidr string) net.IP {
+	cidr = strings.TrimSpace(cidr)
+	if ip, _, err := net.ParseCIDR(cidr); err == nil {
+		return ip
+	}
+	return net.ParseIP(cidr)
+}
+
+// pinnedNode returns node that the claim is pinned to or empty string
+func (s *ipClaimScheduler) pinnedNode(claim *extensions.IpClaim) string {
+	if len(s.Pins) == 0 {
+		return ""
+	}
+	ip := pinnedIP(claim.Spec.Cidr)
+	if ip == nil {
+		return ""
+	}
+	return s.Pins[ip.String()]
+}
+
+// groupPinnedNode returns node that the claim group is pinned to, a pin of
+// any member applies to the whole group so pinned claims do not split it.
+// If members are pinned to different nodes, pin of the member with the
+// lowest name wins
+func (s *ipClaimScheduler) groupPinnedNode(claim *extensions.IpClaim) string {
+	pinned, name := s.pinnedNode(claim), claim.Metadata.Name
+	for _, member := range s.groupMembers(claim) {
+		node := s.pinnedNode(member)
+		if node != "" && (pinned == "" || member.Metadata.Name < name) {
+			pinned, name = node, member.Metadata.Name
+		}
+	}
+	return pinned
+}
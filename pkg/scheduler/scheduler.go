@@ -15,13 +15,16 @@
 package scheduler
 
 import (
-	"errors"
 	"fmt"
+	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Mirantis/k8s-externalipcontroller/pkg/extensions"
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/metrics"
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/netutils"
 	"github.com/Mirantis/k8s-externalipcontroller/pkg/workqueue"
 
 	"github.com/golang/glog"
@@ -33,15 +36,22 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/pkg/api"
 	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 )
 
 const (
 	AutoExternalAnnotationKey   = "external-ip"
 	AutoExternalAnnotationValue = "auto"
+
+	FailedToClaimIPReason = "FailedToClaimIP"
+	ClaimScheduledReason  = "IPClaimScheduled"
+	PoolsExhaustedReason  = "IPPoolsExhausted"
 )
 
 func NewIPClaimScheduler(config *rest.Config, mask string, monitorInterval time.Duration, nodeFilter string) (*ipClaimScheduler, error) {
@@ -63,12 +73,19 @@ func NewIPClaimScheduler(config *rest.Config, mask string, monitorInterval time.
 		},
 	}
 
-	claimSource := cache.NewListWatchFromClient(ext.Client, "ipclaims", api.NamespaceAll, fields.Everything())
+	claimSource := cache.NewListWatchFromClient(ext.Client, extensions.IpClaimResource.Plural, api.NamespaceAll, fields.Everything())
+
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(glog.Infof)
+	eventBroadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: clientset.Core().Events("")})
+	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "ipclaim-scheduler"})
+
 	scheduler := ipClaimScheduler{
 		Config:              config,
 		Clientset:           clientset,
 		ExtensionsClientset: ext,
 		DefaultMask:         mask,
+		Recorder:            recorder,
 
 		monitorPeriod: monitorInterval,
 		serviceSource: serviceSource,
@@ -77,29 +94,55 @@ func NewIPClaimScheduler(config *rest.Config, mask string, monitorInterval time.
 		observedGeneration: make(map[string]int64),
 		liveIpNodes:        make(map[string]struct{}),
 
-		queue:       workqueue.NewQueue(),
+		queue:       workqueue.NewPriorityQueue(),
 		changeQueue: workqueue.NewQueue(),
 	}
 
-	switch nodeFilter {
-	case "fair":
-		scheduler.getNode = scheduler.getFairNode
-	case "first-alive":
-		scheduler.getNode = scheduler.getFirstAliveNode
-	default:
-		return nil, errors.New("Incorrect node filter is provided")
+	scheduler.getNode, err = newNodeFilter(nodeFilter, &scheduler)
+	if err != nil {
+		return nil, err
 	}
 
 	return &scheduler, nil
 }
 
-type nodeFilter func([]*extensions.IpNode) *extensions.IpNode
-
 type ipClaimScheduler struct {
 	Config              *rest.Config
 	Clientset           kubernetes.Interface
 	ExtensionsClientset extensions.ExtensionsClientset
 	DefaultMask         string
+	Recorder            record.EventRecorder
+	// MaxClaimsPerNode limits number of claims scheduled on a single node
+	// regardless of node filter, 0 means no limit
+	MaxClaimsPerNode int
+	// FallbackNode accepts claims that do not fit any other live node
+	FallbackNode string
+	// AuditClaims enables events about every scheduled claim
+	AuditClaims bool
+	// Observer makes scheduler only log changes of services and config
+	// maps, claims and pools are expected to be written by a read-only
+	// extensions clientset
+	Observer bool
+	// WeighSubnets counts subnet claims by number of their addresses
+	// instead of 1 when balancing and limiting claims per node
+	WeighSubnets bool
+	// Pins are nodes that must hold IPs, by IP. Pinned IP is scheduled
+	// only on its node and returns there once the node is live again
+	Pins map[string]string
+	// PinAllowFallback allows scheduling of a pinned IP on other nodes
+	// while its node is not live
+	PinAllowFallback bool
+	// ManagedNetworks limits external IPs that get claims, IPs of services
+	// outside of these networks are ignored. All IPs are managed if it is
+	// empty
+	ManagedNetworks []*net.IPNet
+	// ExportConfigMap is a name of config map in ExportNamespace that
+	// mirrors claims ownership for external tools, empty disables export
+	ExportConfigMap string
+	ExportNamespace string
+	// ExportPeriod is how often ownership is checked for changes and
+	// exported
+	ExportPeriod time.Duration
 
 	serviceSource cache.ListerWatcher
 	claimSource   cache.ListerWatcher
@@ -109,13 +152,24 @@ type ipClaimScheduler struct {
 	liveSync           sync.Mutex
 	liveIpNodes        map[string]struct{}
 
+	// claimStore is published by claim watcher, storeSync guards it for
+	// readers that run outside of scheduler goroutines, e.g. debug handler
+	storeSync    sync.Mutex
 	claimStore   cache.Store
 	serviceStore cache.Store
 
-	getNode nodeFilter
+	getNode NodeFilter
 
-	queue       workqueue.QueueType
+	queue       workqueue.PriorityQueueType
 	changeQueue workqueue.QueueType
+
+	// claimsSynced is set to 1 once claims are listed for the first time
+	claimsSynced int32
+
+	// groupNodes are the latest scheduling decisions for claim groups,
+	// they are used before decisions are observed in claimStore
+	groupSync  sync.Mutex
+	groupNodes map[string]string
 }
 
 func (s *ipClaimScheduler) Run(stop chan struct{}) {
@@ -129,6 +183,9 @@ func (s *ipClaimScheduler) Run(stop chan struct{}) {
 	go s.claimChangeWorker()
 	go s.serviceWatcher(stop)
 	go s.claimWatcher(stop)
+	if s.ExportConfigMap != "" {
+		go s.exportLoop(stop, time.Tick(s.ExportPeriod))
+	}
 	<-stop
 	s.queue.Close()
 	s.changeQueue.Close()
@@ -176,7 +233,12 @@ func (s *ipClaimScheduler) processExternalIPs(svc *v1.Service) {
 	}
 
 	glog.V(2).Infof("Processing svc %s with external ips %v", svc.Name, svc.Spec.ExternalIPs)
-	for _, ip := range svc.Spec.ExternalIPs {
+	for _, externalIP := range svc.Spec.ExternalIPs {
+		ip, mask, err := netutils.ParseExternalIP(externalIP, s.DefaultMask)
+		if err != nil {
+			glog.Errorf("Skipping external IP of a service %s: %v", svc.Name, err)
+			continue
+		}
 		glog.V(2).Infof(
 			"Check IP %s of a service %s for an intersection with pools: %v",
 			ip, svc.Name, pools)
@@ -184,7 +246,11 @@ func (s *ipClaimScheduler) processExternalIPs(svc *v1.Service) {
 			foundAuto = true
 			continue
 		}
-		s.addClaimChangeRequest(makeIPClaim(ip, s.DefaultMask, svc), cache.Added)
+		if !s.isManaged(ip) {
+			glog.V(4).Infof("Ignoring IP %s of a service %s outside of managed networks", ip, svc.Name)
+			continue
+		}
+		s.addClaimChangeRequest(makeIPClaim(ip, mask, svc), cache.Added)
 	}
 	if foundAuto {
 		return
@@ -199,6 +265,20 @@ func (s *ipClaimScheduler) processExternalIPs(svc *v1.Service) {
 	}
 }
 
+// isManaged returns true if ip belongs to one of managed networks
+func (s *ipClaimScheduler) isManaged(ip string) bool {
+	if len(s.ManagedNetworks) == 0 {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	for _, network := range s.ManagedNetworks {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
 func poolByAllocatedIP(ip string, poolList *extensions.IpClaimPoolList) *extensions.IpClaimPool {
 	for _, pool := range poolList.Items {
 		if _, exists := pool.Spec.Allocated[ip]; exists {
@@ -208,13 +288,40 @@ func poolByAllocatedIP(ip string, poolList *extensions.IpClaimPoolList) *extensi
 	return nil
 }
 
+// conflictingPools returns pools which CIDR overlaps with a pool that comes
+// earlier in the list, mapped to the name of that pool. Pools with invalid
+// CIDR are left to AvailableIP to report
+func conflictingPools(poolList *extensions.IpClaimPoolList) map[string]string {
+	conflicting := map[string]string{}
+	for i := range poolList.Items {
+		for j := 0; j < i; j++ {
+			if _, exists := conflicting[poolList.Items[j].Metadata.Name]; exists {
+				continue
+			}
+			overlaps, err := poolList.Items[i].Overlaps(&poolList.Items[j])
+			if err == nil && overlaps {
+				conflicting[poolList.Items[i].Metadata.Name] = poolList.Items[j].Metadata.Name
+				break
+			}
+		}
+	}
+	return conflicting
+}
+
 func (s *ipClaimScheduler) autoAllocateExternalIP(svc *v1.Service, poolList *extensions.IpClaimPoolList, setLBIp bool) {
 	glog.V(5).Infof("Try to auto allocate external IP for service '%v'", svc.ObjectMeta.Name)
 
 	var freeIP string
 	var pool extensions.IpClaimPool
 
+	conflicting := conflictingPools(poolList)
 	for _, p := range poolList.Items {
+		if other, exists := conflicting[p.Metadata.Name]; exists {
+			glog.Warningf(
+				"IP pool '%v' overlaps with pool '%v'; skipping it to avoid duplicate IPs",
+				p.Metadata.Name, other)
+			continue
+		}
 		ip, err := p.AvailableIP()
 		if err != nil {
 			glog.Errorf(
@@ -231,6 +338,10 @@ func (s *ipClaimScheduler) autoAllocateExternalIP(svc *v1.Service, poolList *ext
 		glog.Errorf(
 			"Fail to provide external IP for service '%v'. All pools are exhausted.",
 			svc.ObjectMeta.Name)
+		if s.Recorder != nil {
+			s.Recorder.Eventf(svc, v1.EventTypeWarning, PoolsExhaustedReason,
+				"Failed to allocate external IP: all %d IP pools are exhausted", len(poolList.Items))
+		}
 		return
 	}
 
@@ -239,6 +350,7 @@ func (s *ipClaimScheduler) autoAllocateExternalIP(svc *v1.Service, poolList *ext
 	ipclaim := makeIPClaim(freeIP, mask, svc)
 	ipclaim.Metadata.SetLabels(
 		map[string]string{"ip-pool-name": pool.Metadata.Name})
+	ipclaim.Spec.NodeSelector = pool.Spec.NodeSelector
 
 	s.addClaimChangeRequest(ipclaim, cache.Added)
 
@@ -252,6 +364,11 @@ func (s *ipClaimScheduler) autoAllocateExternalIP(svc *v1.Service, poolList *ext
 		svc.ObjectMeta.Name, freeIP,
 	)
 	svc.Spec.ExternalIPs = append(svc.Spec.ExternalIPs, freeIP)
+	if s.Observer {
+		glog.Infof("observer: action=update service=%s/%s externalIPs=%v loadBalancerIP=%v",
+			svc.Namespace, svc.Name, svc.Spec.ExternalIPs, setLBIp)
+		return
+	}
 	svc, err = s.Clientset.Core().Services(svc.ObjectMeta.Namespace).Update(svc)
 	if err != nil {
 		glog.Errorf("Unable to update ExternalIPs for service '%v'. Details: %v",
@@ -282,8 +399,11 @@ func (s *ipClaimScheduler) claimWatcher(stop chan struct{}) {
 				}
 				s.queue.Add(key)
 			},
-			UpdateFunc: func(_, cur interface{}) {
+			UpdateFunc: func(old, cur interface{}) {
 				claim := cur.(*extensions.IpClaim)
+				if prev := old.(*extensions.IpClaim); prev.Spec.Group != claim.Spec.Group {
+					s.forgetGroup(prev)
+				}
 				glog.V(3).Infof("IP claim '%v' was updated. Resource version: %v",
 					claim.Metadata.Name, claim.Metadata.ResourceVersion)
 				key, err := cache.MetaNamespaceKeyFunc(claim)
@@ -296,13 +416,35 @@ func (s *ipClaimScheduler) claimWatcher(stop chan struct{}) {
 				claim := obj.(*extensions.IpClaim)
 				glog.V(3).Infof("IP claim '%v' was deleted. Resource version: %v",
 					claim.Metadata.Name, claim.Metadata.ResourceVersion)
+				s.forgetGroup(claim)
 			},
 		},
 	)
+	s.storeSync.Lock()
 	s.claimStore = store
+	s.storeSync.Unlock()
+	go func() {
+		if cache.WaitForCacheSync(stop, controller.HasSynced) {
+			glog.V(3).Infof("IP claims are synced")
+			atomic.StoreInt32(&s.claimsSynced, 1)
+		}
+	}()
 	controller.Run(stop)
 }
 
+// claims returns claim store, nil is returned until claim watcher is started
+func (s *ipClaimScheduler) claims() cache.Store {
+	s.storeSync.Lock()
+	defer s.storeSync.Unlock()
+	return s.claimStore
+}
+
+// HasSynced returns true once all claims are listed by the claim watcher,
+// scheduling decisions made before that are based on incomplete claim counts
+func (s *ipClaimScheduler) HasSynced() bool {
+	return atomic.LoadInt32(&s.claimsSynced) == 1
+}
+
 func (s *ipClaimScheduler) findAliveNodes(ipnodes []extensions.IpNode) (result []*extensions.IpNode) {
 	s.liveSync.Lock()
 	s.liveSync.Unlock()
@@ -333,6 +475,14 @@ func (s *ipClaimScheduler) worker() {
 		}
 		glog.V(5).Infof("Processing of IP claim '%v' was completed", key)
 		s.queue.Done(key)
+		s.updateClaimsPerNodeMetric()
+	}
+}
+
+func (s *ipClaimScheduler) updateClaimsPerNodeMetric() {
+	metrics.ClaimsPerNode.Reset()
+	for node, count := range s.ClaimsPerNode() {
+		metrics.ClaimsPerNode.WithLabelValues(node).Set(float64(count))
 	}
 }
 
@@ -380,7 +530,9 @@ func (s *ipClaimScheduler) claimChangeWorker() {
 				glog.Errorf("Unable to create IP claim '%v'. Details: %v", claim.Metadata.Name, err)
 			}
 		case cache.Updated:
+			start := time.Now()
 			_, err := client.Update(claim)
+			metrics.ClaimUpdateLatency.Observe(time.Since(start).Seconds())
 			if err == nil {
 				glog.V(3).Infof("IP claim '%v' was updated with node '%v'. Resource version: %v",
 					claim.Metadata.Name, claim.Spec.NodeName, claim.Metadata.ResourceVersion)
@@ -418,10 +570,20 @@ func (s *ipClaimScheduler) processOldService(svc *v1.Service) {
 	}
 
 	pools := s.getIPClaimPoolList()
-	for _, ip := range svc.Spec.ExternalIPs {
-		if _, ok := refs[ip]; !ok {
-			s.deleteIPClaimAndAllocation(ip, pools)
+	for _, externalIP := range svc.Spec.ExternalIPs {
+		if _, ok := refs[externalIP]; ok {
+			continue
+		}
+		ip, mask, err := netutils.ParseExternalIP(externalIP, s.DefaultMask)
+		if err != nil {
+			glog.Errorf("Skipping external IP of a service %s: %v", svc.Name, err)
+			continue
 		}
+		if !s.isManaged(ip) {
+			glog.V(4).Infof("Ignoring IP %s of a service %s outside of managed networks", ip, svc.Name)
+			continue
+		}
+		s.deleteIPClaimAndAllocation(ip, mask, pools)
 	}
 }
 
@@ -432,9 +594,7 @@ func (s *ipClaimScheduler) getIPClaimByIP(ip string, pools *extensions.IpClaimPo
 	} else {
 		mask = s.DefaultMask
 	}
-	ipParts := strings.Split(ip, ".")
-	key := strings.Join([]string{strings.Join(ipParts, "-"), mask}, "-")
-	return s.ExtensionsClientset.IPClaims().Get(key)
+	return s.ExtensionsClientset.IPClaims().Get(claimName(ip, mask))
 }
 
 func (s *ipClaimScheduler) getIPClaimPoolList() *extensions.IpClaimPoolList {
@@ -445,7 +605,7 @@ func (s *ipClaimScheduler) getIPClaimPoolList() *extensions.IpClaimPoolList {
 	return pools
 }
 
-func (s *ipClaimScheduler) deleteIPClaimAndAllocation(ip string, pools *extensions.IpClaimPoolList) {
+func (s *ipClaimScheduler) deleteIPClaimAndAllocation(ip, mask string, pools *extensions.IpClaimPoolList) {
 	glog.V(5).Infof("adding delete request for a clai with ip %s", ip)
 	if p := poolByAllocatedIP(ip, pools); p != nil {
 		s.addClaimChangeRequest(makeIPClaim(ip, strings.Split(p.Spec.CIDR, "/")[1], nil), cache.Deleted)
@@ -457,7 +617,7 @@ func (s *ipClaimScheduler) deleteIPClaimAndAllocation(ip string, pools *extensio
 			glog.Errorf("Unable to update IP pool '%v'. Details: %v", p.Metadata.Name, err)
 		}
 	} else {
-		s.addClaimChangeRequest(makeIPClaim(ip, s.DefaultMask, nil), cache.Deleted)
+		s.addClaimChangeRequest(makeIPClaim(ip, mask, nil), cache.Deleted)
 	}
 }
 
@@ -495,13 +655,35 @@ func (s *ipClaimScheduler) ownersAlive(claim *extensions.IpClaim) []metav1.Owner
 }
 
 func (s *ipClaimScheduler) processIpClaim(claim *extensions.IpClaim) error {
+	// claims of IPs outside of managed networks belong to other schedulers
+	if len(s.ManagedNetworks) > 0 {
+		if ip := pinnedIP(claim.Spec.Cidr); ip == nil || !s.isManaged(ip.String()) {
+			glog.V(4).Infof("Ignoring claim %s outside of managed networks", claim.Metadata.Name)
+			return nil
+		}
+	}
+	if claim.Metadata.DeletionTimestamp != nil {
+		// cleanup finalizer can be removed only by a controller that holds
+		// the IP, so it is released here if that controller is dead
+		if claim.HasFinalizer() && !s.isLive(claim.Spec.NodeName) {
+			glog.V(3).Infof("Removing finalizer of a claim %s of dead node %s",
+				claim.Metadata.Name, claim.Spec.NodeName)
+			claim.RemoveFinalizer()
+			s.addClaimChangeRequest(claim, cache.Updated)
+		}
+		return nil
+	}
 	glog.V(5).Infof("verifying owners for a claim %s/%s", claim.Metadata.Namespace, claim.Metadata.Name)
 	ownersAlive := s.ownersAlive(claim)
 	if len(ownersAlive) == 0 {
 		glog.V(5).Infof("owners of a claim %s/%s do not exist", claim.Metadata.Namespace, claim.Metadata.Name)
 		// all owner links are irrelevant
 		pools := s.getIPClaimPoolList()
-		s.deleteIPClaimAndAllocation(strings.Split(claim.Spec.Cidr, "/")[0], pools)
+		ip, mask, err := netutils.ParseExternalIP(claim.Spec.Cidr, s.DefaultMask)
+		if err != nil {
+			return err
+		}
+		s.deleteIPClaimAndAllocation(ip, mask, pools)
 		return nil
 	} else if len(ownersAlive) < len(claim.Metadata.OwnerReferences) {
 		// some owner links are irrelevant
@@ -509,30 +691,165 @@ func (s *ipClaimScheduler) processIpClaim(claim *extensions.IpClaim) error {
 		s.addClaimChangeRequest(claim, cache.Updated)
 	}
 	glog.V(5).Infof("owners of a claim %s are alive: %v", claim.Metadata.Name, ownersAlive)
-	if claim.Spec.NodeName != "" && s.isLive(claim.Spec.NodeName) {
+	pinned := s.groupPinnedNode(claim)
+	if claim.Spec.NodeName != "" && s.isLive(claim.Spec.NodeName) &&
+		(pinned == "" || pinned == claim.Spec.NodeName || !s.isLive(pinned)) {
 		return nil
 	}
 	ipnodes, err := s.ExtensionsClientset.IPNodes().List(metav1.ListOptions{})
 	if err != nil {
+		metrics.ScheduleDecisions.WithLabelValues(metrics.ResultError).Inc()
 		return err
 	}
 	// this needs to be queued and requeued in case of node absence
 	if len(ipnodes.Items) == 0 {
+		metrics.ScheduleDecisions.WithLabelValues(metrics.ResultNoFit).Inc()
+		s.recordClaimFailure(claim, "there are no IP nodes")
 		return fmt.Errorf("No nodes")
 	}
 	liveNodes := s.findAliveNodes(ipnodes.Items)
 	if len(liveNodes) == 0 {
+		metrics.ScheduleDecisions.WithLabelValues(metrics.ResultNoFit).Inc()
+		s.recordClaimFailure(claim, "there are no live IP nodes")
 		return fmt.Errorf("No live nodes")
 	}
-	ipnode := s.getNode(liveNodes)
+	pinnedNode := nodeByName(liveNodes, pinned)
+	if pinned != "" && pinnedNode == nil && !s.PinAllowFallback {
+		metrics.ScheduleDecisions.WithLabelValues(metrics.ResultNoFit).Inc()
+		s.recordClaimFailure(claim, fmt.Sprintf("pinned IP node %s is not live", pinned))
+		return fmt.Errorf("Pinned node %s is not live", pinned)
+	}
+	if pinnedNode == nil {
+		liveNodes = nodesMatchingSelector(liveNodes, claim.Spec.NodeSelector)
+		if len(liveNodes) == 0 {
+			metrics.ScheduleDecisions.WithLabelValues(metrics.ResultNoFit).Inc()
+			s.recordClaimFailure(claim, fmt.Sprintf("there are no live IP nodes matching %v", claim.Spec.NodeSelector))
+			return fmt.Errorf("No live nodes match node selector")
+		}
+	}
+	var ipnode *extensions.IpNode
+	if ipnode = pinnedNode; ipnode != nil {
+		glog.V(3).Infof("IP claim '%v' is pinned to node '%v'", claim.Metadata.Name, pinned)
+	} else if ipnode = s.groupNode(claim, liveNodes); ipnode != nil {
+		// group is never split, so a full group node means that claim does
+		// not fit until the node has room for it
+		if len(nodesBelowLimit([]*extensions.IpNode{ipnode}, s.ClaimsPerNode(), s.MaxClaimsPerNode, 1)) == 0 {
+			metrics.ScheduleDecisions.WithLabelValues(metrics.ResultNoFit).Inc()
+			s.recordClaimFailure(claim, fmt.Sprintf("IP node %s of group %s holds maximum number of IPs", ipnode.Metadata.Name, claim.Spec.Group))
+			return fmt.Errorf("Node %s of group %s is full", ipnode.Metadata.Name, claim.Spec.Group)
+		}
+		glog.V(3).Infof("IP claim '%v' follows its group '%v'", claim.Metadata.Name, claim.Spec.Group)
+	} else if candidates := nodesBelowLimit(liveNodes, s.ClaimsPerNode(), s.MaxClaimsPerNode, s.groupSize(claim)); len(candidates) != 0 {
+		ipnode = s.getNode(candidates)
+	} else if ipnode = nodeByName(liveNodes, s.FallbackNode); ipnode != nil {
+		glog.V(3).Infof("IP claim '%v' does not fit any node, using fallback node", claim.Metadata.Name)
+	} else {
+		metrics.ScheduleDecisions.WithLabelValues(metrics.ResultNoFit).Inc()
+		s.recordClaimFailure(claim, "all live IP nodes hold maximum number of IPs")
+		return fmt.Errorf("All live nodes are full")
+	}
+	metrics.ScheduleDecisions.WithLabelValues(metrics.ResultFit).Inc()
 	claim.Metadata.SetLabels(map[string]string{"ipnode": ipnode.Metadata.Name})
 	claim.Spec.NodeName = ipnode.Metadata.Name
+	claim.ResetStatus()
+	s.placeGroup(claim)
 	glog.V(3).Infof("Scheduling IP claim '%v' on a node '%v'",
 		claim.Metadata.Name, claim.Spec.NodeName)
+	if s.AuditClaims {
+		s.recordClaimEvent(claim, v1.EventTypeNormal, ClaimScheduledReason,
+			"IP claim %s (%s) is scheduled on node %s", claim.Metadata.Name, claim.Spec.Cidr, claim.Spec.NodeName)
+	}
 	s.addClaimChangeRequest(claim, cache.Updated)
 	return nil
 }
 
+// recordClaimFailure emits warning event for every service that owns the claim
+func (s *ipClaimScheduler) recordClaimFailure(claim *extensions.IpClaim, reason string) {
+	s.recordClaimEvent(claim, v1.EventTypeWarning, FailedToClaimIPReason,
+		"Failed to schedule IP claim %s (%s): %s", claim.Metadata.Name, claim.Spec.Cidr, reason)
+}
+
+// recordClaimEvent emits event for every service that owns the claim,
+// events are sent asynchronously and dropped if the recorder is overloaded
+func (s *ipClaimScheduler) recordClaimEvent(claim *extensions.IpClaim, eventtype, reason, messageFmt string, args ...interface{}) {
+	if s.Recorder == nil {
+		return
+	}
+	for _, owner := range claim.Metadata.OwnerReferences {
+		obj, exists, err := s.serviceStore.GetByKey(string(owner.UID))
+		if err != nil || !exists {
+			continue
+		}
+		s.Recorder.Eventf(obj.(*v1.Service), eventtype, reason, messageFmt, args...)
+	}
+}
+
+// groupMembers returns other claims of the same group as claim
+func (s *ipClaimScheduler) groupMembers(claim *extensions.IpClaim) []*extensions.IpClaim {
+	members := []*extensions.IpClaim{}
+	if claim.Spec.Group == "" {
+		return members
+	}
+	for _, obj := range s.claimStore.List() {
+		member := obj.(*extensions.IpClaim)
+		if member.Spec.Group == claim.Spec.Group && member.Metadata.Name != claim.Metadata.Name {
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+// groupSize returns number of claims that have to fit a node together with
+// claim, it is 1 for a claim without group
+func (s *ipClaimScheduler) groupSize(claim *extensions.IpClaim) int {
+	return len(s.groupMembers(claim)) + 1
+}
+
+// groupNode returns live node that already holds claims of the claim group,
+// nil is returned if the group is not placed yet or its node is not live
+func (s *ipClaimScheduler) groupNode(claim *extensions.IpClaim, liveNodes []*extensions.IpNode) *extensions.IpNode {
+	if claim.Spec.Group == "" {
+		return nil
+	}
+	s.groupSync.Lock()
+	placed := s.groupNodes[claim.Spec.Group]
+	s.groupSync.Unlock()
+	if node := nodeByName(liveNodes, placed); node != nil {
+		return node
+	}
+	for _, member := range s.groupMembers(claim) {
+		if node := nodeByName(liveNodes, member.Spec.NodeName); node != nil {
+			return node
+		}
+	}
+	return nil
+}
+
+// placeGroup remembers node of the claim group, so other members follow it
+// even if they are processed before the claim update is observed
+func (s *ipClaimScheduler) placeGroup(claim *extensions.IpClaim) {
+	if claim.Spec.Group == "" {
+		return
+	}
+	s.groupSync.Lock()
+	defer s.groupSync.Unlock()
+	if s.groupNodes == nil {
+		s.groupNodes = map[string]string{}
+	}
+	s.groupNodes[claim.Spec.Group] = claim.Spec.NodeName
+}
+
+// forgetGroup drops scheduling decision of the claim group once the claim
+// was its last member
+func (s *ipClaimScheduler) forgetGroup(claim *extensions.IpClaim) {
+	if claim.Spec.Group == "" || len(s.groupMembers(claim)) != 0 {
+		return
+	}
+	s.groupSync.Lock()
+	defer s.groupSync.Unlock()
+	delete(s.groupNodes, claim.Spec.Group)
+}
+
 func (s *ipClaimScheduler) monitorIPNodes(stop chan struct{}, ticker <-chan time.Time) {
 	for {
 		select {
@@ -548,8 +865,11 @@ func (s *ipClaimScheduler) monitorIPNodes(stop chan struct{}, ticker <-chan time
 				name := ipnode.Metadata.Name
 				version := s.observedGeneration[name]
 				curVersion := ipnode.Revision
-				if version < curVersion {
+				alive := version < curVersion
+				if alive {
 					s.observedGeneration[name] = curVersion
+				}
+				if alive && !NodeDrained(&ipnode) {
 					s.liveSync.Lock()
 					glog.V(3).Infof("IP node '%v' is alive. Versions: %v - %v",
 						name, version, curVersion)
@@ -557,8 +877,12 @@ func (s *ipClaimScheduler) monitorIPNodes(stop chan struct{}, ticker <-chan time
 					s.liveSync.Unlock()
 				} else {
 					s.liveSync.Lock()
-					glog.V(3).Infof("IP node '%v' is dead. Versions: %v - %v",
-						name, version, curVersion)
+					if alive {
+						glog.V(3).Infof("IP node '%v' is drained", name)
+					} else {
+						glog.V(3).Infof("IP node '%v' is dead. Versions: %v - %v",
+							name, version, curVersion)
+					}
 					delete(s.liveIpNodes, name)
 					s.liveSync.Unlock()
 					labelSelector := labels.Set(map[string]string{"ipnode": name})
@@ -579,7 +903,9 @@ func (s *ipClaimScheduler) monitorIPNodes(stop chan struct{}, ticker <-chan time
 						if err != nil {
 							glog.Errorf("Error getting key for IP claim: %v", err)
 						} else {
-							s.queue.Add(key)
+							// claims of a dead node are not served, so they are more
+							// urgent than new ones
+							s.queue.AddWithPriority(key, workqueue.PriorityHigh)
 						}
 					}
 				}
@@ -625,9 +951,24 @@ func updatePoolAllocation(ext extensions.ExtensionsClientset, pool *extensions.I
 	return err
 }
 
+// claimName returns name of IP claim for a given ip and mask. Names must be
+// valid DNS subdomains, so both IPv4 dots and IPv6 colons are replaced with
+// dashes. IPv6 address is fully expanded to keep names unambiguous
+func claimName(ip, mask string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() != nil {
+		ipParts := strings.Split(ip, ".")
+		return strings.Join([]string{strings.Join(ipParts, "-"), mask}, "-")
+	}
+	groups := make([]string, 0, net.IPv6len/2)
+	for i := 0; i < net.IPv6len; i += 2 {
+		groups = append(groups, fmt.Sprintf("%02x%02x", parsed[i], parsed[i+1]))
+	}
+	return strings.Join([]string{strings.Join(groups, "-"), mask}, "-")
+}
+
 func makeIPClaim(ip, mask string, svc *v1.Service) *extensions.IpClaim {
-	ipParts := strings.Split(ip, ".")
-	key := strings.Join([]string{strings.Join(ipParts, "-"), mask}, "-")
+	key := claimName(ip, mask)
 	cidr := strings.Join([]string{ip, mask}, "/")
 
 	glog.V(2).Infof("Creating IP claim '%v'", key)
@@ -15,11 +15,14 @@
 package scheduler
 
 import (
+	"fmt"
+	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/Mirantis/k8s-externalipcontroller/pkg/extensions"
 	fclient "github.com/Mirantis/k8s-externalipcontroller/pkg/extensions/testing"
+	"github.com/Mirantis/k8s-externalipcontroller/pkg/netutils"
 	"github.com/Mirantis/k8s-externalipcontroller/pkg/workqueue"
 
 	"github.com/Mirantis/k8s-externalipcontroller/pkg/utils"
@@ -32,8 +35,73 @@ import (
 	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/tools/cache"
 	fcache "k8s.io/client-go/tools/cache/testing"
+	"k8s.io/client-go/tools/record"
 )
 
+func TestManagedNetworks(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	networks, err := netutils.ParseNetworks([]string{"10.10.0.0/24", "fd00::/64"})
+	assert.NoError(t, err)
+	s := ipClaimScheduler{
+		DefaultMask:         "32",
+		ExtensionsClientset: ext,
+		ManagedNetworks:     networks,
+		changeQueue:         workqueue.NewQueue(),
+	}
+	defer s.changeQueue.Close()
+	ext.Ipclaimpools.On("List", mock.Anything).Return(&extensions.IpClaimPoolList{}, nil)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "test0", Namespace: api.NamespaceDefault},
+		Spec:       v1.ServiceSpec{ExternalIPs: []string{"10.10.0.2", "10.10.1.2", "fd00::2/128", "fd01::2/128"}}}
+	s.processExternalIPs(svc)
+
+	assert.Equal(t, 2, s.changeQueue.Len(), "Only IPs from managed networks should get claims")
+	for _, cidr := range []string{"10.10.0.2/32", "fd00::2/128"} {
+		req, _ := s.changeQueue.Get()
+		claim := req.(*cache.Delta).Object.(*extensions.IpClaim)
+		assert.Equal(t, cidr, claim.Spec.Cidr)
+		s.changeQueue.Done(req)
+	}
+
+	_, err = netutils.ParseNetworks([]string{"10.10.0.2"})
+	assert.Error(t, err)
+}
+
+func TestManagedNetworksClaims(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	networks, err := netutils.ParseNetworks([]string{"10.10.0.0/24"})
+	assert.NoError(t, err)
+	fss := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	s := ipClaimScheduler{
+		DefaultMask:         "32",
+		ExtensionsClientset: ext,
+		ManagedNetworks:     networks,
+		serviceStore:        fss,
+		claimStore:          cache.NewStore(cache.MetaNamespaceKeyFunc),
+		liveIpNodes:         map[string]struct{}{"first": {}},
+		changeQueue:         workqueue.NewQueue(),
+	}
+	defer s.changeQueue.Close()
+	ext.Ipclaimpools.On("List", mock.Anything).Return(&extensions.IpClaimPoolList{}, nil)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "test0", Namespace: api.NamespaceDefault},
+		Spec:       v1.ServiceSpec{ExternalIPs: []string{"10.10.0.2", "10.10.1.2"}}}
+	s.processOldService(svc)
+	assert.Equal(t, 1, s.changeQueue.Len(), "Only claims of managed IPs should be deleted")
+	req, _ := s.changeQueue.Get()
+	assert.Equal(t, cache.Deleted, req.(*cache.Delta).Type)
+	assert.Equal(t, "10.10.0.2/32", req.(*cache.Delta).Object.(*extensions.IpClaim).Spec.Cidr)
+	s.changeQueue.Done(req)
+
+	fss.Add(svc)
+	claim := makeIPClaim("10.10.1.2", "32", svc)
+	assert.NoError(t, s.processIpClaim(claim))
+	assert.Equal(t, "", claim.Spec.NodeName, "Claim outside of managed networks should not be scheduled")
+	assert.Equal(t, 0, s.changeQueue.Len())
+}
+
 func TestServiceWatcher(t *testing.T) {
 	ext := fclient.NewFakeExtClientset()
 	lw := fcache.NewFakeControllerSource()
@@ -76,6 +144,36 @@ func TestServiceWatcher(t *testing.T) {
 	assert.Equal(t, ipclaimName, "10-10-0-2-24", "Unexpected name")
 }
 
+func TestClaimPerExternalIP(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	s := ipClaimScheduler{
+		DefaultMask:         "32",
+		ExtensionsClientset: ext,
+		changeQueue:         workqueue.NewQueue(),
+	}
+	defer s.changeQueue.Close()
+	ext.Ipclaimpools.On("List", mock.Anything).Return(&extensions.IpClaimPoolList{}, nil)
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "test0", Namespace: api.NamespaceDefault},
+		Spec:       v1.ServiceSpec{ExternalIPs: []string{"10.10.0.2", "10.10.0.3"}}}
+	s.processExternalIPs(svc)
+
+	assert.Equal(t, 2, s.changeQueue.Len(), "Claim should be created for every external IP")
+	for _, name := range []string{"10-10-0-2-32", "10-10-0-3-32"} {
+		req, _ := s.changeQueue.Get()
+		delta := req.(*cache.Delta)
+		claim := delta.Object.(*extensions.IpClaim)
+		assert.Equal(t, cache.Added, delta.Type)
+		assert.Equal(t, name, claim.Metadata.Name)
+		if assert.Len(t, claim.Metadata.OwnerReferences, 1) {
+			assert.Equal(t, types.UID("default/test0"), claim.Metadata.OwnerReferences[0].UID,
+				"Claim should reference its service")
+		}
+		s.changeQueue.Done(req)
+	}
+}
+
 func TestAutoAllocationForServices(t *testing.T) {
 	ext := fclient.NewFakeExtClientset()
 	lw := fcache.NewFakeControllerSource()
@@ -179,6 +277,111 @@ func TestAutoAllocationForServices(t *testing.T) {
 		"Allocated should not contain '192-168-16-250-29'")
 }
 
+func TestObserverAutoAllocation(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	svc := v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "need-alloc-svc",
+			Annotations: map[string]string{"external-ip": "auto"},
+			Namespace:   api.NamespaceDefault,
+		},
+	}
+	fakeClientset := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{svc}})
+	s := ipClaimScheduler{
+		DefaultMask:         "24",
+		ExtensionsClientset: extensions.NewReadOnlyClientset(ext),
+		Clientset:           fakeClientset,
+		Observer:            true,
+		changeQueue:         workqueue.NewQueue(),
+		claimsSynced:        1,
+		ExportConfigMap:     "claims",
+		ExportNamespace:     api.NamespaceDefault,
+		claimStore:          cache.NewStore(cache.MetaNamespaceKeyFunc),
+	}
+	defer s.changeQueue.Close()
+	poolList := &extensions.IpClaimPoolList{Items: []extensions.IpClaimPool{{
+		Metadata: metav1.ObjectMeta{Name: "test-pool"},
+		Spec:     extensions.IpClaimPoolSpec{CIDR: "192.168.16.248/29"},
+	}}}
+	ext.Ipclaimpools.On("List", mock.Anything).Return(poolList, nil)
+	fakeClientset.ClearActions()
+
+	s.autoAllocateExternalIP(&svc, poolList, true)
+	s.claimStore.Add(&extensions.IpClaim{
+		Metadata: metav1.ObjectMeta{Name: "192-168-16-249-29"},
+		Spec:     extensions.IpClaimSpec{Cidr: "192.168.16.249/29", NodeName: "first"},
+	})
+	_, err := s.exportClaims("")
+	assert.NoError(t, err)
+
+	assert.Empty(t, fakeClientset.Actions(), "Observer should not write services or config maps")
+	for _, call := range ext.Ipclaimpools.Calls {
+		assert.NotEqual(t, "Update", call.Method, "Observer should not update pools")
+	}
+}
+
+func TestAutoAllocationPoolsExhausted(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	svc := v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "need-alloc-svc",
+			Annotations: map[string]string{"external-ip": "auto"},
+			Namespace:   api.NamespaceDefault,
+		},
+	}
+	fakeClientset := fake.NewSimpleClientset(&v1.ServiceList{Items: []v1.Service{svc}})
+	recorder := record.NewFakeRecorder(1)
+	s := ipClaimScheduler{
+		ExtensionsClientset: ext,
+		Clientset:           fakeClientset,
+		Recorder:            recorder,
+		changeQueue:         workqueue.NewQueue(),
+	}
+	defer s.changeQueue.Close()
+	poolList := &extensions.IpClaimPoolList{Items: []extensions.IpClaimPool{{
+		Metadata: metav1.ObjectMeta{Name: "small-pool"},
+		Spec: extensions.IpClaimPoolSpec{
+			CIDR: "10.20.0.0/30",
+			Allocated: map[string]string{
+				"10.20.0.1": "10-20-0-1-30",
+				"10.20.0.2": "10-20-0-2-30",
+			},
+		},
+	}}}
+
+	s.autoAllocateExternalIP(&svc, poolList, false)
+	select {
+	case event := <-recorder.Events:
+		assert.Contains(t, event, PoolsExhaustedReason)
+	case <-time.After(time.Second):
+		t.Errorf("Expected event about exhausted pools")
+	}
+	assert.Equal(t, 0, s.changeQueue.Len(), "Claim should not be created without free IP")
+	assert.Empty(t, ext.Ipclaimpools.Calls, "Pool allocation should not be changed")
+	pending, _ := fakeClientset.Core().Services(svc.ObjectMeta.Namespace).Get(svc.ObjectMeta.Name, metav1.GetOptions{})
+	assert.Empty(t, pending.Spec.ExternalIPs, "Service should stay pending")
+}
+
+func TestConflictingPools(t *testing.T) {
+	pool := func(name, cidr string) extensions.IpClaimPool {
+		return extensions.IpClaimPool{
+			Metadata: metav1.ObjectMeta{Name: name},
+			Spec:     extensions.IpClaimPoolSpec{CIDR: cidr},
+		}
+	}
+	poolList := &extensions.IpClaimPoolList{Items: []extensions.IpClaimPool{
+		pool("first", "10.20.0.0/30"),
+		pool("touching", "10.20.0.4/30"),
+		pool("inside-first", "10.20.0.2/31"),
+		pool("wide", "10.20.0.0/24"),
+		pool("invalid", "10.20.0.1"),
+	}}
+	assert.Equal(t, map[string]string{
+		"inside-first": "first",
+		"wide":         "first",
+	}, conflictingPools(poolList))
+}
+
 func TestClaimNotCreatedIfExternalIPIsAutoAllocated(t *testing.T) {
 	ext := fclient.NewFakeExtClientset()
 	lw := fcache.NewFakeControllerSource()
@@ -325,7 +528,7 @@ func TestClaimWatcher(t *testing.T) {
 		serviceStore:        fss,
 		ExtensionsClientset: ext,
 		liveIpNodes:         make(map[string]struct{}),
-		queue:               workqueue.NewQueue(),
+		queue:               workqueue.NewPriorityQueue(),
 		changeQueue:         workqueue.NewQueue(),
 	}
 	s.getNode = s.getFairNode
@@ -381,7 +584,7 @@ func TestMonitorIpNodes(t *testing.T) {
 		ExtensionsClientset: ext,
 		liveIpNodes:         make(map[string]struct{}),
 		observedGeneration:  make(map[string]int64),
-		queue:               workqueue.NewQueue(),
+		queue:               workqueue.NewPriorityQueue(),
 	}
 	ipnodesList := &extensions.IpNodeList{
 		Items: []extensions.IpNode{
@@ -429,3 +632,617 @@ func TestMonitorIpNodes(t *testing.T) {
 	}, "Unexpected call count to ipclaims", ext.Ipclaims.Calls)
 	assert.Equal(t, s.isLive("first"), false, "first node shouldn't be considered live")
 }
+
+func TestMonitorDrainedIpNode(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	stop := make(chan struct{})
+	defer close(stop)
+	ticker := make(chan time.Time)
+	s := ipClaimScheduler{
+		ExtensionsClientset: ext,
+		liveIpNodes:         make(map[string]struct{}),
+		observedGeneration:  make(map[string]int64),
+		queue:               workqueue.NewPriorityQueue(),
+	}
+	defer s.queue.Close()
+	ipnode := extensions.IpNode{Metadata: metav1.ObjectMeta{Name: "first"}, Revision: 1}
+	ipclaimsList := &extensions.IpClaimList{Items: []extensions.IpClaim{{
+		Metadata: metav1.ObjectMeta{Name: "10-10-0-1-24", Labels: map[string]string{"ipnode": "first"}},
+		Spec:     extensions.IpClaimSpec{Cidr: "10.10.0.1/24", NodeName: "first"},
+	}}}
+	drained := ipnode
+	drained.Revision = 2
+	drained.Metadata.Annotations = map[string]string{NodeDrainAnnotationKey: "true"}
+	undrained := ipnode
+	undrained.Revision = 3
+	ext.Ipnodes.On("List", mock.Anything).Return(&extensions.IpNodeList{Items: []extensions.IpNode{ipnode}}, nil).Once()
+	ext.Ipnodes.On("List", mock.Anything).Return(&extensions.IpNodeList{Items: []extensions.IpNode{drained}}, nil).Once()
+	ext.Ipnodes.On("List", mock.Anything).Return(&extensions.IpNodeList{Items: []extensions.IpNode{undrained}}, nil).Once()
+	ext.Ipclaims.On("List", mock.Anything).Return(ipclaimsList, nil)
+	go s.monitorIPNodes(stop, ticker)
+
+	ticker <- time.Time{}
+	utils.EventualCondition(t, time.Second*1, func() bool {
+		return s.isLive("first")
+	}, "Node with new revision should be live")
+
+	ticker <- time.Time{}
+	utils.EventualCondition(t, time.Second*1, func() bool {
+		return s.queue.Len() == 1
+	}, "Claims of drained node should be sent for rescheduling")
+	assert.False(t, s.isLive("first"), "Drained node should not get claims")
+
+	ticker <- time.Time{}
+	utils.EventualCondition(t, time.Second*1, func() bool {
+		return s.isLive("first")
+	}, "Node should be live again once drain annotation is removed")
+}
+
+func TestFairNodeWeights(t *testing.T) {
+	s := ipClaimScheduler{
+		claimStore: cache.NewStore(cache.MetaNamespaceKeyFunc),
+	}
+	for _, claim := range []struct{ name, node string }{
+		{"10-10-0-1-24", "first"},
+		{"10-10-0-2-24", "first"},
+		{"10-10-0-3-24", "first"},
+		{"10-10-0-4-24", "second"},
+	} {
+		s.claimStore.Add(&extensions.IpClaim{
+			Metadata: metav1.ObjectMeta{Name: claim.name},
+			Spec:     extensions.IpClaimSpec{NodeName: claim.node},
+		})
+	}
+	first := &extensions.IpNode{Metadata: metav1.ObjectMeta{Name: "first"}}
+	second := &extensions.IpNode{Metadata: metav1.ObjectMeta{Name: "second"}}
+	ipnodes := []*extensions.IpNode{first, second}
+
+	assert.Equal(t, "second", s.getFairNode(ipnodes).Metadata.Name,
+		"Node with less claims should be selected when weights are equal")
+
+	first.Metadata.Annotations = map[string]string{NodeWeightAnnotationKey: "4"}
+	assert.Equal(t, "first", s.getFairNode(ipnodes).Metadata.Name,
+		"Node with bigger weight should accept more claims")
+	assert.Equal(t, map[string]float64{"first": 4, "second": 1}, NodeWeights(ipnodes))
+
+	first.Metadata.Annotations = map[string]string{NodeWeightAnnotationKey: "-1"}
+	assert.Equal(t, 1.0, NodeWeight(first), "Incorrect weight should fall back to default")
+}
+
+func TestMaxClaimsPerNode(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	fss := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "some-svc", Namespace: api.NamespaceDefault},
+	}
+	fss.Add(svc)
+	s := ipClaimScheduler{
+		serviceStore:        fss,
+		claimStore:          cache.NewStore(cache.MetaNamespaceKeyFunc),
+		ExtensionsClientset: ext,
+		MaxClaimsPerNode:    4,
+		liveIpNodes:         map[string]struct{}{"first": {}, "second": {}},
+		changeQueue:         workqueue.NewQueue(),
+	}
+	defer s.changeQueue.Close()
+	s.getNode = FairNodeFilter(&s)
+	for i, node := range []string{"first", "first", "first", "first", "second", "second", "second"} {
+		s.claimStore.Add(&extensions.IpClaim{
+			Metadata: metav1.ObjectMeta{Name: fmt.Sprintf("10-10-0-%d-32", i)},
+			Spec:     extensions.IpClaimSpec{NodeName: node},
+		})
+	}
+	// first node is the emptiest one because of its weight
+	ipnodesList := &extensions.IpNodeList{
+		Items: []extensions.IpNode{
+			{Metadata: metav1.ObjectMeta{Name: "first", Annotations: map[string]string{NodeWeightAnnotationKey: "4"}}},
+			{Metadata: metav1.ObjectMeta{Name: "second"}},
+		},
+	}
+	ext.Ipnodes.On("List", mock.Anything).Return(ipnodesList, nil)
+
+	claim := makeIPClaim("10.10.0.10", "32", svc)
+	assert.NoError(t, s.processIpClaim(claim))
+	assert.Equal(t, "second", claim.Spec.NodeName, "Node that holds maximum number of claims should be skipped")
+
+	s.claimStore.Add(claim)
+	claim = makeIPClaim("10.10.0.11", "32", svc)
+	assert.Error(t, s.processIpClaim(claim), "Claim should not be scheduled when all nodes are full")
+	assert.Equal(t, "", claim.Spec.NodeName)
+
+	s.FallbackNode = "first"
+	assert.NoError(t, s.processIpClaim(claim))
+	assert.Equal(t, "first", claim.Spec.NodeName, "Fallback node should accept claim that does not fit")
+}
+
+func TestClaimNodeSelector(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	fss := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "some-svc", Namespace: api.NamespaceDefault},
+	}
+	fss.Add(svc)
+	s := ipClaimScheduler{
+		serviceStore:        fss,
+		claimStore:          cache.NewStore(cache.MetaNamespaceKeyFunc),
+		ExtensionsClientset: ext,
+		liveIpNodes:         map[string]struct{}{"worker": {}, "edge": {}},
+		changeQueue:         workqueue.NewQueue(),
+	}
+	defer s.changeQueue.Close()
+	s.getNode = FirstAliveNodeFilter(&s)
+	ipnodesList := &extensions.IpNodeList{
+		Items: []extensions.IpNode{
+			{Metadata: metav1.ObjectMeta{Name: "worker", Labels: map[string]string{"role": "worker"}}},
+			{Metadata: metav1.ObjectMeta{Name: "edge", Labels: map[string]string{"role": "edge"}}},
+		},
+	}
+	ext.Ipnodes.On("List", mock.Anything).Return(ipnodesList, nil)
+
+	claim := makeIPClaim("10.10.0.10", "32", svc)
+	assert.NoError(t, s.processIpClaim(claim))
+	assert.Equal(t, "worker", claim.Spec.NodeName, "Claim without selector should fit any node")
+
+	claim = makeIPClaim("10.10.0.11", "32", svc)
+	claim.Spec.NodeSelector = map[string]string{"role": "edge"}
+	assert.NoError(t, s.processIpClaim(claim))
+	assert.Equal(t, "edge", claim.Spec.NodeName, "Claim should be scheduled on node matching selector")
+
+	claim = makeIPClaim("10.10.0.12", "32", svc)
+	claim.Spec.NodeSelector = map[string]string{"role": "storage"}
+	assert.Error(t, s.processIpClaim(claim), "Claim should not fit nodes that do not match selector")
+	assert.Equal(t, "", claim.Spec.NodeName)
+}
+
+func TestClaimGroup(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	fss := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "some-svc", Namespace: api.NamespaceDefault},
+	}
+	fss.Add(svc)
+	s := ipClaimScheduler{
+		serviceStore:        fss,
+		claimStore:          cache.NewStore(cache.MetaNamespaceKeyFunc),
+		ExtensionsClientset: ext,
+		liveIpNodes:         map[string]struct{}{"first": {}, "second": {}, "third": {}},
+		changeQueue:         workqueue.NewQueue(),
+	}
+	defer s.changeQueue.Close()
+	s.getNode = FairNodeFilter(&s)
+	ipnodesList := &extensions.IpNodeList{
+		Items: []extensions.IpNode{
+			{Metadata: metav1.ObjectMeta{Name: "first"}},
+			{Metadata: metav1.ObjectMeta{Name: "second"}},
+			{Metadata: metav1.ObjectMeta{Name: "third"}},
+		},
+	}
+	ext.Ipnodes.On("List", mock.Anything).Return(ipnodesList, nil)
+	// addClaim adds a copy of claim to store, so scheduling decisions are
+	// not observed until the copy is updated
+	addClaim := func(ip, node, group string) *extensions.IpClaim {
+		claim := makeIPClaim(ip, "32", svc)
+		claim.Spec.NodeName = node
+		claim.Spec.Group = group
+		stored := *claim
+		s.claimStore.Add(&stored)
+		return claim
+	}
+
+	addClaim("10.10.0.10", "first", "")
+	addClaim("10.10.0.11", "second", "")
+	primary := addClaim("10.10.0.2", "", "db")
+	secondary := addClaim("10.10.0.3", "", "db")
+	assert.NoError(t, s.processIpClaim(primary))
+	assert.Equal(t, "third", primary.Spec.NodeName)
+	addClaim("10.10.0.12", "third", "")
+	addClaim("10.10.0.13", "third", "")
+	assert.NoError(t, s.processIpClaim(secondary))
+	assert.Equal(t, "third", secondary.Spec.NodeName, "Group should not be split by fair node filter")
+
+	// failover: members stored on a dead node move together
+	s.liveIpNodes = map[string]struct{}{"first": {}, "second": {}}
+	primary = addClaim("10.10.0.2", "third", "db")
+	secondary = addClaim("10.10.0.3", "third", "db")
+	assert.NoError(t, s.processIpClaim(primary))
+	addClaim("10.10.0.14", primary.Spec.NodeName, "")
+	addClaim("10.10.0.15", primary.Spec.NodeName, "")
+	assert.NoError(t, s.processIpClaim(secondary))
+	assert.NotEqual(t, "third", primary.Spec.NodeName)
+	assert.Equal(t, primary.Spec.NodeName, secondary.Spec.NodeName, "Group members should move together")
+}
+
+func TestClaimGroupLimitAndPin(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	fss := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "some-svc", Namespace: api.NamespaceDefault},
+	}
+	fss.Add(svc)
+	s := ipClaimScheduler{
+		serviceStore:        fss,
+		claimStore:          cache.NewStore(cache.MetaNamespaceKeyFunc),
+		ExtensionsClientset: ext,
+		MaxClaimsPerNode:    2,
+		liveIpNodes:         map[string]struct{}{"first": {}, "second": {}},
+		changeQueue:         workqueue.NewQueue(),
+	}
+	defer s.changeQueue.Close()
+	s.getNode = FairNodeFilter(&s)
+	ipnodesList := &extensions.IpNodeList{
+		Items: []extensions.IpNode{
+			{Metadata: metav1.ObjectMeta{Name: "first"}},
+			{Metadata: metav1.ObjectMeta{Name: "second"}},
+		},
+	}
+	ext.Ipnodes.On("List", mock.Anything).Return(ipnodesList, nil)
+	addClaim := func(ip, node, group string) *extensions.IpClaim {
+		claim := makeIPClaim(ip, "32", svc)
+		claim.Spec.NodeName = node
+		claim.Spec.Group = group
+		stored := *claim
+		s.claimStore.Add(&stored)
+		return claim
+	}
+
+	primary := addClaim("10.10.0.2", "first", "db")
+	addClaim("10.10.0.10", "first", "")
+	secondary := addClaim("10.10.0.3", "", "db")
+	assert.Error(t, s.processIpClaim(secondary), "Group member should not exceed limit of its group node")
+	assert.Equal(t, "", secondary.Spec.NodeName, "Group member should not be split from its group")
+
+	// pin of one member pins the whole group
+	s.MaxClaimsPerNode = 0
+	s.Pins = map[string]string{"10.10.0.3": "second"}
+	assert.NoError(t, s.processIpClaim(secondary))
+	assert.Equal(t, "second", secondary.Spec.NodeName)
+	assert.NoError(t, s.processIpClaim(primary))
+	assert.Equal(t, "second", primary.Spec.NodeName, "Group should follow pin of its member")
+
+	// decision is dropped with the last group member
+	s.claimStore.Delete(secondary)
+	s.forgetGroup(secondary)
+	assert.Equal(t, "second", s.groupNodes["db"])
+	s.claimStore.Delete(primary)
+	s.forgetGroup(primary)
+	assert.NotContains(t, s.groupNodes, "db")
+}
+
+func TestRescheduledClaimStatus(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	fss := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "some-svc", Namespace: api.NamespaceDefault},
+	}
+	fss.Add(svc)
+	s := ipClaimScheduler{
+		serviceStore:        fss,
+		claimStore:          cache.NewStore(cache.MetaNamespaceKeyFunc),
+		ExtensionsClientset: ext,
+		liveIpNodes:         map[string]struct{}{"second": {}},
+		changeQueue:         workqueue.NewQueue(),
+	}
+	defer s.changeQueue.Close()
+	s.getNode = FirstAliveNodeFilter(&s)
+	ipnodesList := &extensions.IpNodeList{
+		Items: []extensions.IpNode{
+			{Metadata: metav1.ObjectMeta{Name: "first"}},
+			{Metadata: metav1.ObjectMeta{Name: "second"}},
+		},
+	}
+	ext.Ipnodes.On("List", mock.Anything).Return(ipnodesList, nil)
+
+	claim := makeIPClaim("10.10.0.2", "32", svc)
+	claim.Spec.NodeName = "first"
+	claim.Status = extensions.IpClaimStatus{NodeName: "first", State: extensions.IpClaimAssigned}
+	assert.NoError(t, s.processIpClaim(claim))
+	assert.Equal(t, "second", claim.Spec.NodeName)
+	assert.Equal(t, extensions.IpClaimUnassigned, claim.Status.State)
+	assert.Equal(t, "", claim.Status.NodeName)
+	assert.Equal(t, "first", claim.Status.PreviousNodeName, "Node that had the IP should be kept")
+	assert.True(t, claim.WasAssigned())
+}
+
+func TestNodesBelowLimitGroup(t *testing.T) {
+	nodes := []*extensions.IpNode{
+		{Metadata: metav1.ObjectMeta{Name: "first"}},
+		{Metadata: metav1.ObjectMeta{Name: "second"}},
+	}
+	counter := map[string]int{"first": 2, "second": 1}
+	assert.Len(t, nodesBelowLimit(nodes, counter, 3, 1), 2)
+	candidates := nodesBelowLimit(nodes, counter, 3, 2)
+	if assert.Len(t, candidates, 1, "Group should fit a node as a whole") {
+		assert.Equal(t, "second", candidates[0].Metadata.Name)
+	}
+	assert.Empty(t, nodesBelowLimit(nodes, counter, 3, 3))
+}
+
+func TestPinnedClaim(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	fss := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "some-svc", Namespace: api.NamespaceDefault},
+	}
+	fss.Add(svc)
+	pins, err := ParsePins([]string{"10.10.0.2/32=second"})
+	assert.NoError(t, err)
+	s := ipClaimScheduler{
+		serviceStore:        fss,
+		claimStore:          cache.NewStore(cache.MetaNamespaceKeyFunc),
+		ExtensionsClientset: ext,
+		Pins:                pins,
+		liveIpNodes:         map[string]struct{}{"first": {}, "second": {}},
+		changeQueue:         workqueue.NewQueue(),
+	}
+	defer s.changeQueue.Close()
+	s.getNode = FairNodeFilter(&s)
+	ipnodesList := &extensions.IpNodeList{
+		Items: []extensions.IpNode{
+			{Metadata: metav1.ObjectMeta{Name: "first"}},
+			{Metadata: metav1.ObjectMeta{Name: "second"}},
+		},
+	}
+	ext.Ipnodes.On("List", mock.Anything).Return(ipnodesList, nil)
+	// fair node filter prefers the first node
+	s.claimStore.Add(&extensions.IpClaim{
+		Metadata: metav1.ObjectMeta{Name: "10-10-0-10-32"},
+		Spec:     extensions.IpClaimSpec{Cidr: "10.10.0.10/32", NodeName: "second"},
+	})
+
+	claim := makeIPClaim("10.10.0.2", "32", svc)
+	assert.NoError(t, s.processIpClaim(claim))
+	assert.Equal(t, "second", claim.Spec.NodeName, "Pinned IP should be scheduled on its node")
+
+	delete(s.liveIpNodes, "second")
+	claim.Spec.NodeName = ""
+	assert.Error(t, s.processIpClaim(claim), "Pinned IP should not be scheduled while its node is not live")
+	assert.Equal(t, "", claim.Spec.NodeName)
+
+	s.PinAllowFallback = true
+	assert.NoError(t, s.processIpClaim(claim))
+	assert.Equal(t, "first", claim.Spec.NodeName, "Pinned IP should fall back to other nodes if allowed")
+
+	s.liveIpNodes["second"] = struct{}{}
+	assert.NoError(t, s.processIpClaim(claim))
+	assert.Equal(t, "second", claim.Spec.NodeName, "Pinned IP should return to its node once it is live")
+
+	for _, pin := range []string{"10.10.0.2", "10.10.0.2=", "garbage=second"} {
+		_, err := ParsePins([]string{pin})
+		assert.Error(t, err, "Pin %v should be rejected", pin)
+	}
+}
+
+func TestExportClaims(t *testing.T) {
+	fakeClientset := fake.NewSimpleClientset()
+	s := ipClaimScheduler{
+		Clientset:       fakeClientset,
+		ExportConfigMap: "ipclaims",
+		ExportNamespace: "kube-system",
+		claimStore:      cache.NewStore(cache.MetaNamespaceKeyFunc),
+	}
+	claim := &extensions.IpClaim{
+		Metadata: metav1.ObjectMeta{Name: "10-10-0-2-32"},
+		Spec:     extensions.IpClaimSpec{Cidr: "10.10.0.2/32", NodeName: "first"},
+	}
+	s.claimStore.Add(claim)
+	s.claimStore.Add(&extensions.IpClaim{
+		Metadata: metav1.ObjectMeta{Name: "10-10-0-3-32"},
+		Spec:     extensions.IpClaimSpec{Cidr: "10.10.0.3/32"},
+	})
+	exported, err := s.exportClaims("")
+	assert.NoError(t, err)
+	assert.Empty(t, fakeClientset.Actions(), "Claims should not be exported before they are synced")
+
+	s.claimsSynced = 1
+	exported, err = s.exportClaims(exported)
+	assert.NoError(t, err)
+	configMap, err := fakeClientset.Core().ConfigMaps("kube-system").Get("ipclaims", metav1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `{"10.10.0.2/32": "first"}`, configMap.Data[ExportedClaimsKey],
+			"Only scheduled claims should be exported")
+	}
+
+	updated := *claim
+	updated.Spec.NodeName = "second"
+	s.claimStore.Update(&updated)
+	exported, err = s.exportClaims(exported)
+	assert.NoError(t, err)
+	configMap, err = fakeClientset.Core().ConfigMaps("kube-system").Get("ipclaims", metav1.GetOptions{})
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `{"10.10.0.2/32": "second"}`, configMap.Data[ExportedClaimsKey],
+			"Config map should be updated when ownership changes")
+	}
+
+	actions := len(fakeClientset.Actions())
+	_, err = s.exportClaims(exported)
+	assert.NoError(t, err)
+	assert.Len(t, fakeClientset.Actions(), actions, "Unchanged ownership should not be exported again")
+}
+
+func TestSubnetClaimWeight(t *testing.T) {
+	s := ipClaimScheduler{claimStore: cache.NewStore(cache.MetaNamespaceKeyFunc)}
+	s.claimStore.Add(&extensions.IpClaim{
+		Metadata: metav1.ObjectMeta{Name: "10-10-0-0-28"},
+		Spec:     extensions.IpClaimSpec{Cidr: "10.10.0.0/28", NodeName: "first"},
+	})
+	for i, cidr := range []string{"10.10.1.1/24", "10.10.1.2/24"} {
+		s.claimStore.Add(&extensions.IpClaim{
+			Metadata: metav1.ObjectMeta{Name: fmt.Sprintf("10-10-1-%d-24", i+1)},
+			Spec:     extensions.IpClaimSpec{Cidr: cidr, NodeName: "second"},
+		})
+	}
+	nodes := []*extensions.IpNode{
+		{Metadata: metav1.ObjectMeta{Name: "first"}},
+		{Metadata: metav1.ObjectMeta{Name: "second"}},
+	}
+	assert.Equal(t, map[string]int{"first": 1, "second": 2}, s.ClaimsPerNode())
+	assert.Equal(t, "first", FairNodeFilter(&s)(nodes).Metadata.Name)
+
+	s.WeighSubnets = true
+	assert.Equal(t, map[string]int{"first": 16, "second": 2}, s.ClaimsPerNode())
+	assert.Equal(t, "second", FairNodeFilter(&s)(nodes).Metadata.Name,
+		"Node with a /28 subnet should be considered more loaded")
+}
+
+func TestFailedClaimEvent(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	fss := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "some-svc", Namespace: api.NamespaceDefault},
+		Spec:       v1.ServiceSpec{ExternalIPs: []string{"10.10.0.2"}},
+	}
+	fss.Add(svc)
+	recorder := record.NewFakeRecorder(1)
+	s := ipClaimScheduler{
+		serviceStore:        fss,
+		ExtensionsClientset: ext,
+		Recorder:            recorder,
+		liveIpNodes:         make(map[string]struct{}),
+	}
+	ipnodesList := &extensions.IpNodeList{
+		Items: []extensions.IpNode{{Metadata: metav1.ObjectMeta{Name: "first"}}},
+	}
+	ext.Ipnodes.On("List", mock.Anything).Return(ipnodesList, nil)
+
+	claim := makeIPClaim("10.10.0.2", "24", svc)
+	assert.Error(t, s.processIpClaim(claim), "Claim should not be scheduled without live nodes")
+	select {
+	case event := <-recorder.Events:
+		assert.Contains(t, event, FailedToClaimIPReason)
+		assert.Contains(t, event, claim.Metadata.Name)
+	case <-time.After(time.Second):
+		t.Errorf("Expected event about failed IP claim")
+	}
+}
+
+func TestClaimAuditEvent(t *testing.T) {
+	ext := fclient.NewFakeExtClientset()
+	fss := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "some-svc", Namespace: api.NamespaceDefault},
+	}
+	fss.Add(svc)
+	recorder := record.NewFakeRecorder(1)
+	s := ipClaimScheduler{
+		serviceStore:        fss,
+		claimStore:          cache.NewStore(cache.MetaNamespaceKeyFunc),
+		ExtensionsClientset: ext,
+		Recorder:            recorder,
+		AuditClaims:         true,
+		liveIpNodes:         map[string]struct{}{"first": {}},
+		changeQueue:         workqueue.NewQueue(),
+	}
+	defer s.changeQueue.Close()
+	s.getNode = FirstAliveNodeFilter(&s)
+	ipnodesList := &extensions.IpNodeList{
+		Items: []extensions.IpNode{{Metadata: metav1.ObjectMeta{Name: "first"}}},
+	}
+	ext.Ipnodes.On("List", mock.Anything).Return(ipnodesList, nil)
+
+	claim := makeIPClaim("10.10.0.2", "32", svc)
+	assert.NoError(t, s.processIpClaim(claim))
+	select {
+	case event := <-recorder.Events:
+		assert.Contains(t, event, ClaimScheduledReason)
+		assert.Contains(t, event, "10.10.0.2/32")
+		assert.Contains(t, event, "first")
+	case <-time.After(time.Second):
+		t.Errorf("Expected event about scheduled IP claim")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	s := ipClaimScheduler{
+		claimStore:  cache.NewStore(cache.MetaNamespaceKeyFunc),
+		liveIpNodes: map[string]struct{}{"second": {}, "first": {}},
+		queue:       workqueue.NewPriorityQueue(),
+	}
+	defer s.queue.Close()
+	for _, claim := range []struct{ name, node string }{
+		{"10-10-0-2-32", "first"},
+		{"10-10-0-3-32", "first"},
+		{"10-10-0-4-32", "second"},
+		{"10-10-0-5-32", ""},
+	} {
+		s.claimStore.Add(&extensions.IpClaim{
+			Metadata: metav1.ObjectMeta{Name: claim.name},
+			Spec:     extensions.IpClaimSpec{NodeName: claim.node},
+		})
+	}
+	s.queue.Add("10-10-0-5-32")
+
+	assert.Equal(t, Snapshot{
+		LiveNodes:     []string{"first", "second"},
+		ClaimsPerNode: map[string]int{"first": 2, "second": 1},
+		QueueLength:   1,
+	}, s.Snapshot())
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/claims", nil))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	assert.JSONEq(t,
+		`{"liveNodes":["first","second"],"claimsPerNode":{"first":2,"second":1},"queueLength":1}`,
+		rec.Body.String())
+}
+
+func TestSnapshotConcurrentRead(t *testing.T) {
+	s := ipClaimScheduler{liveIpNodes: map[string]struct{}{"first": {}}}
+	assert.Empty(t, s.Snapshot().ClaimsPerNode, "Snapshot should be served before claims are watched")
+
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.storeSync.Lock()
+		s.claimStore = store
+		s.storeSync.Unlock()
+		for i := 0; i < 1000; i++ {
+			claim := &extensions.IpClaim{
+				Metadata: metav1.ObjectMeta{Name: fmt.Sprintf("10-10-0-%d-32", i%10)},
+				Spec:     extensions.IpClaimSpec{NodeName: "first"},
+			}
+			store.Add(claim)
+			store.Delete(claim)
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		s.Snapshot()
+	}
+	<-done
+	assert.Empty(t, s.Snapshot().ClaimsPerNode)
+}
+
+func TestClaimName(t *testing.T) {
+	for _, tc := range []struct {
+		ip, mask, expected string
+	}{
+		{"10.10.0.2", "24", "10-10-0-2-24"},
+		{"2001:db8::1", "64", "2001-0db8-0000-0000-0000-0000-0000-0001-64"},
+		{"2001:db8:0:0:0:0:0:1", "64", "2001-0db8-0000-0000-0000-0000-0000-0001-64"},
+		{"2001:db8::1:0:0:1", "128", "2001-0db8-0000-0000-0001-0000-0000-0001-128"},
+	} {
+		assert.Equal(t, tc.expected, claimName(tc.ip, tc.mask))
+	}
+	claim := makeIPClaim("2001:db8::1", "64", nil)
+	assert.Equal(t, "2001:db8::1/64", claim.Spec.Cidr)
+}
+
+func TestRegisterNodeFilter(t *testing.T) {
+	last := &extensions.IpNode{Metadata: metav1.ObjectMeta{Name: "last"}}
+	RegisterNodeFilter("test-last", func(_ ClaimCounter) NodeFilter {
+		return func(ipnodes []*extensions.IpNode) *extensions.IpNode {
+			return ipnodes[len(ipnodes)-1]
+		}
+	})
+	assert.Contains(t, NodeFilterNames(), "test-last")
+	assert.Contains(t, NodeFilterNames(), DefaultNodeFilter)
+
+	s := &ipClaimScheduler{}
+	filter, err := newNodeFilter("test-last", s)
+	assert.NoError(t, err)
+	first := &extensions.IpNode{Metadata: metav1.ObjectMeta{Name: "first"}}
+	assert.Equal(t, last, filter([]*extensions.IpNode{first, last}))
+
+	_, err = newNodeFilter("unknown", s)
+	assert.Error(t, err, "Unknown node filter should not be resolved")
+}
@@ -0,0 +1,44 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package version holds build information injected by the linker, e.g.
+// -ldflags "-X github.com/Mirantis/k8s-externalipcontroller/pkg/version.Version=v0.2.0"
+package version
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+var (
+	// Version is a release of the build, usually a git tag
+	Version = "unknown"
+	// GitCommit is a commit the build was made from
+	GitCommit = "unknown"
+	// BuildDate is a build time in RFC 3339 format
+	BuildDate = "unknown"
+)
+
+// String returns build information in a single line
+func String() string {
+	return fmt.Sprintf("version=%s commit=%s date=%s go=%s", Version, GitCommit, BuildDate, runtime.Version())
+}
+
+// Fprint writes build information to w, it is used by --version flag
+func Fprint(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "Version: %s\nGit commit: %s\nBuild date: %s\nGo version: %s\n",
+		Version, GitCommit, BuildDate, runtime.Version())
+	return err
+}
@@ -0,0 +1,34 @@
+// Copyright 2016 Mirantis
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package version
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFprint(t *testing.T) {
+	defer func(v, c, d string) { Version, GitCommit, BuildDate = v, c, d }(Version, GitCommit, BuildDate)
+	Version, GitCommit, BuildDate = "v0.2.0", "9c4498b", "2017-08-01T10:00:00Z"
+
+	var buf bytes.Buffer
+	assert.NoError(t, Fprint(&buf))
+	assert.Contains(t, buf.String(), "Version: v0.2.0\n")
+	assert.Contains(t, buf.String(), "Git commit: 9c4498b\n")
+	assert.Contains(t, buf.String(), "Build date: 2017-08-01T10:00:00Z\n")
+	assert.Contains(t, String(), "version=v0.2.0 commit=9c4498b")
+}
@@ -16,6 +16,7 @@ package workqueue
 
 import (
 	"sync"
+	"time"
 )
 
 type QueueAddType interface {
@@ -29,12 +30,16 @@ type QueueType interface {
 	Remove(interface{})
 	Close()
 	Len() int
+	// OldestAge returns how long the oldest queued item waits for
+	// processing, 0 if there are no queued items
+	OldestAge() time.Duration
 }
 
 func NewQueue() *Queue {
 	return &Queue{
 		cond:       sync.NewCond(&sync.Mutex{}),
 		added:      map[interface{}]bool{},
+		addedAt:    map[interface{}]time.Time{},
 		processing: map[interface{}]bool{},
 		queue:      []interface{}{},
 	}
@@ -43,6 +48,7 @@ func NewQueue() *Queue {
 type Queue struct {
 	cond       *sync.Cond
 	added      map[interface{}]bool
+	addedAt    map[interface{}]time.Time
 	processing map[interface{}]bool
 	closed     bool
 	queue      []interface{}
@@ -58,6 +64,7 @@ func (n *Queue) Add(item interface{}) {
 		return
 	}
 	n.added[item] = true
+	n.addedAt[item] = time.Now()
 	if _, exists := n.processing[item]; exists {
 		return
 	}
@@ -66,6 +73,8 @@ func (n *Queue) Add(item interface{}) {
 }
 
 func (n *Queue) Len() int {
+	n.cond.L.Lock()
+	defer n.cond.L.Unlock()
 	return len(n.queue)
 }
 
@@ -80,30 +89,47 @@ func (n *Queue) Get() (item interface{}, quit bool) {
 	n.cond.L.Lock()
 	defer n.cond.L.Unlock()
 
-	if len(n.queue) == 0 && !n.closed {
-		n.cond.Wait()
-	}
-
-	if len(n.queue) == 0 {
-		return nil, n.closed
-	}
-
 	for {
+		// other workers may take the item we were woken up for
+		for len(n.queue) == 0 && !n.closed {
+			n.cond.Wait()
+		}
+		if len(n.queue) == 0 {
+			return nil, n.closed
+		}
 		item, n.queue = n.queue[0], n.queue[1:]
 		// item was removed and shouldn't be processed
 		if _, exists := n.added[item]; !exists {
-			if len(n.queue) == 0 {
-				return nil, n.closed
-			}
 			continue
 		}
 		break
 	}
 	n.processing[item] = true
 	delete(n.added, item)
+	delete(n.addedAt, item)
 	return item, false
 }
 
+func (n *Queue) OldestAge() time.Duration {
+	n.cond.L.Lock()
+	defer n.cond.L.Unlock()
+	return oldestAge(n.addedAt)
+}
+
+// oldestAge returns time passed since the earliest of timestamps
+func oldestAge(addedAt map[interface{}]time.Time) time.Duration {
+	var oldest time.Time
+	for _, added := range addedAt {
+		if oldest.IsZero() || added.Before(oldest) {
+			oldest = added
+		}
+	}
+	if oldest.IsZero() {
+		return 0
+	}
+	return time.Since(oldest)
+}
+
 func (n *Queue) Done(item interface{}) {
 	n.cond.L.Lock()
 	defer n.cond.L.Unlock()
@@ -123,6 +149,7 @@ func (n *Queue) Remove(item interface{}) {
 
 	if _, exists := n.added[item]; exists {
 		delete(n.added, item)
+		delete(n.addedAt, item)
 	}
 }
 
@@ -143,3 +170,158 @@ func (p *ProcessingQueue) Process(f func(item interface{}) error) error {
 	}
 	return nil
 }
+
+const (
+	PriorityNormal = 0
+	PriorityHigh   = 10
+)
+
+type PriorityQueueType interface {
+	QueueType
+	AddWithPriority(interface{}, int)
+}
+
+func NewPriorityQueue() *PriorityQueue {
+	return &PriorityQueue{
+		cond:       sync.NewCond(&sync.Mutex{}),
+		added:      map[interface{}]int{},
+		addedAt:    map[interface{}]time.Time{},
+		processing: map[interface{}]bool{},
+		queues:     map[int][]interface{}{},
+	}
+}
+
+// PriorityQueue returns items with higher priority first, items with the same
+// priority are returned in the order they were added
+type PriorityQueue struct {
+	cond       *sync.Cond
+	added      map[interface{}]int
+	addedAt    map[interface{}]time.Time
+	processing map[interface{}]bool
+	closed     bool
+	queues     map[int][]interface{}
+	levels     []int
+}
+
+func (n *PriorityQueue) Add(item interface{}) {
+	n.AddWithPriority(item, PriorityNormal)
+}
+
+// AddWithPriority adds item with a given priority, priority of already added
+// item will be raised if a new one is higher
+func (n *PriorityQueue) AddWithPriority(item interface{}, priority int) {
+	n.cond.L.Lock()
+	defer n.cond.L.Unlock()
+	if n.closed {
+		return
+	}
+	current, exists := n.added[item]
+	if exists && current >= priority {
+		return
+	}
+	if !exists {
+		n.addedAt[item] = time.Now()
+	}
+	n.added[item] = priority
+	if _, exists := n.processing[item]; exists {
+		return
+	}
+	if exists {
+		n.drop(item, current)
+	}
+	n.push(item, priority)
+	n.cond.Signal()
+}
+
+func (n *PriorityQueue) push(item interface{}, priority int) {
+	if _, exists := n.queues[priority]; !exists {
+		i := 0
+		for i < len(n.levels) && n.levels[i] > priority {
+			i++
+		}
+		n.levels = append(n.levels[:i], append([]int{priority}, n.levels[i:]...)...)
+	}
+	n.queues[priority] = append(n.queues[priority], item)
+}
+
+// drop removes item from the queue of a given priority level
+func (n *PriorityQueue) drop(item interface{}, priority int) {
+	queue := n.queues[priority]
+	for i := range queue {
+		if queue[i] == item {
+			n.queues[priority] = append(queue[:i], queue[i+1:]...)
+			return
+		}
+	}
+}
+
+func (n *PriorityQueue) len() int {
+	length := 0
+	for _, queue := range n.queues {
+		length += len(queue)
+	}
+	return length
+}
+
+func (n *PriorityQueue) Len() int {
+	n.cond.L.Lock()
+	defer n.cond.L.Unlock()
+	return n.len()
+}
+
+func (n *PriorityQueue) Close() {
+	n.cond.L.Lock()
+	defer n.cond.L.Unlock()
+	n.closed = true
+	n.cond.Broadcast()
+}
+
+func (n *PriorityQueue) Get() (item interface{}, quit bool) {
+	n.cond.L.Lock()
+	defer n.cond.L.Unlock()
+
+	for n.len() == 0 && !n.closed {
+		n.cond.Wait()
+	}
+
+	for _, level := range n.levels {
+		if len(n.queues[level]) > 0 {
+			item, n.queues[level] = n.queues[level][0], n.queues[level][1:]
+			n.processing[item] = true
+			delete(n.added, item)
+			delete(n.addedAt, item)
+			return item, false
+		}
+	}
+	return nil, n.closed
+}
+
+func (n *PriorityQueue) OldestAge() time.Duration {
+	n.cond.L.Lock()
+	defer n.cond.L.Unlock()
+	return oldestAge(n.addedAt)
+}
+
+func (n *PriorityQueue) Done(item interface{}) {
+	n.cond.L.Lock()
+	defer n.cond.L.Unlock()
+
+	delete(n.processing, item)
+
+	if priority, exists := n.added[item]; exists {
+		n.push(item, priority)
+		n.cond.Signal()
+	}
+}
+
+// Remove will prevent item from being processed
+func (n *PriorityQueue) Remove(item interface{}) {
+	n.cond.L.Lock()
+	defer n.cond.L.Unlock()
+
+	if priority, exists := n.added[item]; exists && !n.processing[item] {
+		n.drop(item, priority)
+	}
+	delete(n.added, item)
+	delete(n.addedAt, item)
+}
@@ -16,7 +16,10 @@ package workqueue
 
 import (
 	"fmt"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestQueue(t *testing.T) {
@@ -61,3 +64,172 @@ func TestProcessQueue(t *testing.T) {
 		return nil
 	})
 }
+
+func TestPriorityQueue(t *testing.T) {
+	queue := NewPriorityQueue()
+	queue.Add(1)
+	queue.Add(2)
+	queue.AddWithPriority(3, PriorityHigh)
+	queue.AddWithPriority(4, PriorityHigh)
+	// raises priority of already added item
+	queue.AddWithPriority(2, PriorityHigh)
+	queue.Remove(4)
+	for _, expected := range []int{3, 2, 1} {
+		item, _ := queue.Get()
+		if citem := item.(int); citem != expected {
+			t.Errorf("item expected to be %v - %v", expected, citem)
+		}
+		queue.Done(item)
+	}
+	if queue.Len() != 0 {
+		t.Errorf("queue expected to be empty - %v", queue.Len())
+	}
+	queue.Close()
+	item, closed := queue.Get()
+	if item != nil {
+		t.Errorf("expected to return nil if empty")
+	}
+	if !closed {
+		t.Errorf("queue expected to be closed")
+	}
+}
+
+func TestPriorityQueueRaisedOnce(t *testing.T) {
+	queue := NewPriorityQueue()
+	queue.Add(1)
+	queue.Add(2)
+	queue.AddWithPriority(1, PriorityHigh)
+	if queue.Len() != 2 {
+		t.Errorf("expected 2 items in queue - %v", queue.Len())
+	}
+	item, _ := queue.Get()
+	if item.(int) != 1 {
+		t.Errorf("item expected to be 1 - %v", item)
+	}
+	// added again while processing, must be queued once after Done
+	queue.Add(1)
+	queue.Done(item)
+	if queue.Len() != 2 {
+		t.Errorf("expected 2 items in queue - %v", queue.Len())
+	}
+	for _, expected := range []int{2, 1} {
+		item, _ := queue.Get()
+		if citem := item.(int); citem != expected {
+			t.Errorf("item expected to be %v - %v", expected, citem)
+		}
+		queue.Done(item)
+	}
+	if queue.Len() != 0 {
+		t.Errorf("queue expected to be empty - %v", queue.Len())
+	}
+}
+
+func TestPriorityQueueConcurrentAdd(t *testing.T) {
+	queue := NewPriorityQueue()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			queue.Add(fmt.Sprintf("normal-%d", i))
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			queue.AddWithPriority(fmt.Sprintf("high-%d", i), PriorityHigh)
+		}(i)
+	}
+	wg.Wait()
+	if queue.Len() != 100 {
+		t.Errorf("expected 100 items in queue - %v", queue.Len())
+	}
+	for i := 0; i < 100; i++ {
+		item, _ := queue.Get()
+		prefix := "normal-"
+		if i < 50 {
+			prefix = "high-"
+		}
+		if !strings.HasPrefix(item.(string), prefix) {
+			t.Errorf("item %v expected to have prefix %v", item, prefix)
+		}
+		queue.Done(item)
+	}
+}
+
+func TestQueueConcurrentWorkers(t *testing.T) {
+	for _, queue := range []QueueType{NewQueue(), NewPriorityQueue()} {
+		var lock sync.Mutex
+		processed := map[interface{}]int{}
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					item, quit := queue.Get()
+					if quit {
+						return
+					}
+					if item == nil {
+						t.Errorf("nil item returned from open queue")
+						continue
+					}
+					lock.Lock()
+					processed[item]++
+					lock.Unlock()
+					queue.Done(item)
+				}
+			}()
+		}
+		for i := 0; i < 100; i++ {
+			queue.Add(i)
+		}
+		for queue.Len() != 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond)
+		queue.Close()
+		wg.Wait()
+		if len(processed) != 100 {
+			t.Errorf("expected 100 items to be processed - %v", len(processed))
+		}
+		for item, count := range processed {
+			if count != 1 {
+				t.Errorf("item %v expected to be processed once - %v", item, count)
+			}
+		}
+	}
+}
+
+func TestQueueDeduplicatesItems(t *testing.T) {
+	for _, queue := range []QueueType{NewQueue(), NewPriorityQueue()} {
+		for i := 0; i < 3; i++ {
+			queue.Add("10.10.0.2/24")
+		}
+		if queue.Len() != 1 {
+			t.Errorf("item expected to be queued once - %v", queue.Len())
+		}
+	}
+}
+
+func TestQueueOldestAge(t *testing.T) {
+	for _, queue := range []QueueType{NewQueue(), NewPriorityQueue()} {
+		if age := queue.OldestAge(); age != 0 {
+			t.Errorf("empty queue expected to have zero age - %v", age)
+		}
+		queue.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		queue.Add(2)
+		if age := queue.OldestAge(); age < 50*time.Millisecond || age > time.Second {
+			t.Errorf("age expected to reflect the first item delay - %v", age)
+		}
+		item, _ := queue.Get()
+		queue.Done(item)
+		if age := queue.OldestAge(); age >= 50*time.Millisecond {
+			t.Errorf("age expected to be counted from the second item - %v", age)
+		}
+		queue.Remove(2)
+		if age := queue.OldestAge(); age != 0 {
+			t.Errorf("age of removed items expected to be ignored - %v", age)
+		}
+	}
+}